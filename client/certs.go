@@ -10,20 +10,37 @@ import (
 )
 
 // loadTLSCredentials will load the CA who signed the server's certificate
-// and verify its authenticity.
-func loadTLSCredentials(path string) (credentials.TransportCredentials, error) {
-	// Load the CA certificate that signed the server's cert
-	pemServerCA, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("read file: %w", err)
+// and verify its authenticity. If a client certificate and key are given,
+// they are presented to the server for mutual TLS.
+func loadTLSCredentials(caPath, certPath, keyPath string) (credentials.TransportCredentials, error) {
+	config := &tls.Config{}
+
+	if caPath != "" {
+		// Load the CA certificate that signed the server's cert
+		pemServerCA, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("read file: %w", err)
+		}
+
+		// Append the CA cert to a new cert pool
+		cp := x509.NewCertPool()
+		if !cp.AppendCertsFromPEM(pemServerCA) {
+			return nil, fmt.Errorf("failed to add server CA's certificate")
+		}
+
+		config.RootCAs = cp
 	}
 
-	// Append the CA cert to a new cert pool
-	cp := x509.NewCertPool()
-	if !cp.AppendCertsFromPEM(pemServerCA) {
-		return nil, fmt.Errorf("failed to add server CA's certificate")
+	if certPath != "" || keyPath != "" {
+		// Load the client certificate and its private key
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
 	}
 
-	// Create and return TLS credentials from the cert pool
-	return credentials.NewTLS(&tls.Config{RootCAs: cp}), nil
+	// Create and return TLS credentials
+	return credentials.NewTLS(config), nil
 }
@@ -4,12 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/depado/capybara/pb"
 	"github.com/google/uuid"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 // ErrLockNotClaimed is an error returned when the desired lock can't be
@@ -19,6 +23,7 @@ var ErrLockNotClaimed = errors.New("lock not claimed")
 // Client is the main client struct. Use NewClient to initialize a new one.
 type Client struct {
 	who  string
+	md   *pb.HolderMetadata
 	ctx  context.Context
 	capy pb.CapybaraClient
 	conn *grpc.ClientConn
@@ -31,12 +36,24 @@ type Client struct {
 // token will be passed to all subsequent requests made with the client.
 // CertPath: Path to the server's certificate authority certiticate. Given a
 // proper certificate, this option will ensure the connection is encrypted.
+// ClientCertPath, ClientKeyPath: Paths to the client certificate and its
+// private key, used when the server requires mutual TLS. When the server
+// accepts the certificate and enables certificate authentication, the token
+// can be omitted if a non-admin token named after the certificate's common
+// name exists.
 // Who: Unique identifier. If this option isn't provided, a unique ID will be
 // generated on the fly.
+// JobID, Labels: Metadata attached to the locks claimed by the client, along
+// with the hostname and process ID which are filled automatically. They are
+// shown to anyone inspecting the locks or failing to claim them.
 type ClientOpts struct {
-	Token    string
-	CertPath string
-	Who      string
+	Token          string
+	CertPath       string
+	ClientCertPath string
+	ClientKeyPath  string
+	Who            string
+	JobID          string
+	Labels         map[string]string
 }
 
 // NewClient creates a new capybara client using the given capybara GRPc address
@@ -45,21 +62,21 @@ type ClientOpts struct {
 func NewClient(addr string, opts ClientOpts) (*Client, error) {
 	var (
 		err error
-		ctx context.Context
 		who string
 	)
 
+	ctx := context.Background()
 	creds := insecure.NewCredentials()
 
 	if opts.Token != "" {
 		ctx = metadata.NewOutgoingContext(
-			context.Background(),
+			ctx,
 			metadata.New(map[string]string{"token": opts.Token}),
 		)
 	}
 
-	if opts.CertPath != "" {
-		if creds, err = loadTLSCredentials(opts.CertPath); err != nil {
+	if opts.CertPath != "" || opts.ClientCertPath != "" {
+		if creds, err = loadTLSCredentials(opts.CertPath, opts.ClientCertPath, opts.ClientKeyPath); err != nil {
 			return nil, fmt.Errorf("load credentials: %w", err)
 		}
 	}
@@ -75,7 +92,24 @@ func NewClient(addr string, opts ClientOpts) (*Client, error) {
 		return nil, fmt.Errorf("dial: %w", err)
 	}
 
-	return &Client{who: who, ctx: ctx, capy: pb.NewCapybaraClient(conn), conn: conn}, nil
+	// The hostname is informative only, failing to get it isn't an error
+	hostname, _ := os.Hostname()
+	md := &pb.HolderMetadata{
+		Hostname: hostname,
+		Pid:      int64(os.Getpid()),
+		JobId:    opts.JobID,
+		Labels:   opts.Labels,
+	}
+
+	return &Client{who: who, md: md, ctx: ctx, capy: pb.NewCapybaraClient(conn), conn: conn}, nil
+}
+
+// WithReason returns a copy of the client attaching the given reason to the
+// locks it claims. The copy shares the client's connection.
+func (c Client) WithReason(reason string) *Client {
+	c.md = proto.Clone(c.md).(*pb.HolderMetadata)
+	c.md.Reason = reason
+	return &c
 }
 
 // Close will close the internal grpc connection.
@@ -90,11 +124,20 @@ func (c Client) WhoAmI() string {
 	return c.who
 }
 
+// withToken returns a copy of ctx carrying the client's token.
+func (c Client) withToken(ctx context.Context) context.Context {
+	if md, ok := metadata.FromOutgoingContext(c.ctx); ok {
+		return metadata.NewOutgoingContext(ctx, md)
+	}
+
+	return ctx
+}
+
 // ClaimLockRaw claims the given lock and returns the LockResponse.
 // The pb.LockResponse.Acquired field should be checked to confirm the lock
 // has been acquired.
 func (c Client) ClaimLockRaw(lock string) (*pb.LockResponse, error) {
-	pr, err := c.capy.ClaimLock(c.ctx, &pb.LockRequest{Key: lock, Who: c.who})
+	pr, err := c.capy.ClaimLock(c.ctx, &pb.LockRequest{Key: lock, Who: c.who, Metadata: c.md})
 	if err != nil {
 		return nil, err
 	}
@@ -105,19 +148,140 @@ func (c Client) ClaimLockRaw(lock string) (*pb.LockResponse, error) {
 // ClaimLock will claim the given lock and return an error if it can't
 // successfully claim said lock.
 func (c Client) ClaimLock(lock string) (*pb.LockResponse, error) {
-	pr, err := c.capy.ClaimLock(c.ctx, &pb.LockRequest{Key: lock, Who: c.who})
+	pr, err := c.capy.ClaimLock(c.ctx, &pb.LockRequest{Key: lock, Who: c.who, Metadata: c.md})
 	if err != nil {
 		return nil, err
 	}
 
-	if !pr.Acquired && pr.Owner != c.who {
+	if !pr.Acquired && !heldBy(pr, c.who, false) {
 		return pr, ErrLockNotClaimed
 	}
 
 	return pr, nil
 }
 
+// ClaimSharedLock will claim the given lock in shared mode, alongside the
+// other shared holders, and return an error if it can't successfully claim
+// said lock.
+func (c Client) ClaimSharedLock(lock string) (*pb.LockResponse, error) {
+	pr, err := c.capy.ClaimLock(c.ctx, &pb.LockRequest{Key: lock, Who: c.who, Shared: true, Metadata: c.md})
+	if err != nil {
+		return nil, err
+	}
+
+	if !pr.Acquired && !heldBy(pr, c.who, true) {
+		return pr, ErrLockNotClaimed
+	}
+
+	return pr, nil
+}
+
+// heldBy returns whether the lock is held by who in the requested mode. An
+// exclusive lock satisfies a shared request.
+func heldBy(pr *pb.LockResponse, who string, shared bool) bool {
+	if !shared && pr.Shared {
+		return false
+	}
+
+	for _, h := range pr.Holders {
+		if h.Owner == who {
+			return true
+		}
+	}
+
+	return pr.Owner == who
+}
+
+// WaitLock claims the given lock, waiting for it to be released or to expire
+// if it is owned by another client. Use a context with a deadline or a
+// cancel function to stop waiting.
+func (c Client) WaitLock(ctx context.Context, lock string) (*pb.LockResponse, error) {
+	return c.capy.WaitLock(c.withToken(ctx), &pb.LockRequest{Key: lock, Who: c.who, Metadata: c.md})
+}
+
+// RefreshLock extends the given lock, which must be owned by the client. The
+// lock is never acquired: an error with the NotFound, FailedPrecondition or
+// PermissionDenied code is returned if the lock doesn't exist, expired or
+// is owned by another client. A zero ttl uses the server's default.
+func (c Client) RefreshLock(ctx context.Context, lock string, ttl time.Duration) (*pb.LockResponse, error) {
+	lr := &pb.LockRequest{Key: lock, Who: c.who}
+	if ttl != 0 {
+		lr.TTL = durationpb.New(ttl)
+	}
+
+	return c.capy.RefreshLock(c.withToken(ctx), lr)
+}
+
+// ReleaseLock releases the given lock, which must be owned by the client.
 func (c Client) ReleaseLock(lock string) error {
 	_, err := c.capy.ReleaseLock(c.ctx, &pb.ReleaseRequest{Key: lock, Who: c.who})
 	return err
 }
+
+// ClaimLocks claims several locks atomically and returns them sorted by key.
+// Either all of them are claimed, or none is and ErrLockNotClaimed is
+// returned along with the locks as they were found.
+func (c Client) ClaimLocks(ctx context.Context, locks []string) ([]*pb.LockInfo, error) {
+	pr, err := c.capy.ClaimLocks(c.withToken(ctx), &pb.LocksRequest{Keys: locks, Who: c.who, Metadata: c.md})
+	if err != nil {
+		return nil, err
+	}
+
+	if !pr.Acquired {
+		return pr.Locks, ErrLockNotClaimed
+	}
+
+	return pr.Locks, nil
+}
+
+// ReleaseLocks releases several locks owned by the client at once. The locks
+// owned by the client are released even if an error is returned because some
+// of the others aren't.
+func (c Client) ReleaseLocks(ctx context.Context, locks []string) error {
+	_, err := c.capy.ReleaseLocks(c.withToken(ctx), &pb.ReleaseLocksRequest{Keys: locks, Who: c.who})
+	return err
+}
+
+// WatchLocks streams the events of the given lock, or of every lock whose key
+// starts with lock if prefix is true. If current is true, the stream starts
+// with a CURRENT event for the lock, or for every held lock starting with the
+// prefix. Cancel the context to stop watching.
+func (c Client) WatchLocks(ctx context.Context, lock string, prefix, current bool) (pb.Capybara_WatchLocksClient, error) {
+	return c.capy.WatchLocks(c.withToken(ctx), &pb.WatchRequest{Key: lock, Prefix: prefix, WithCurrent: current})
+}
+
+// ForceReleaseLock releases the given lock whoever holds it, or only the
+// given owner's hold if owner isn't empty, and returns the released holders.
+// The reason is recorded in the server logs. This call requires an admin
+// token or a lock scope with the admin access.
+func (c Client) ForceReleaseLock(ctx context.Context, lock, owner, reason string) ([]*pb.Holder, error) {
+	resp, err := c.capy.ForceReleaseLock(c.withToken(ctx), &pb.ForceReleaseRequest{Key: lock, Owner: owner, Reason: reason})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Holders, nil
+}
+
+// GetLock returns the details of the given lock without claiming it. Expired
+// holders are left out unless includeExpired is true.
+func (c Client) GetLock(ctx context.Context, lock string, includeExpired bool) (*pb.LockInfo, error) {
+	return c.capy.GetLock(c.withToken(ctx), &pb.GetLockRequest{Key: lock, IncludeExpired: includeExpired})
+}
+
+// ListLocks returns a page of the locks whose key starts with prefix. The
+// returned token must be given as pageToken to get the next page, it is empty
+// on the last page. A zero limit uses the server's default.
+func (c Client) ListLocks(ctx context.Context, prefix string, limit uint32, pageToken string, includeExpired bool) ([]*pb.LockInfo, string, error) {
+	resp, err := c.capy.ListLocks(c.withToken(ctx), &pb.ListLocksRequest{
+		Prefix:         prefix,
+		Limit:          limit,
+		PageToken:      pageToken,
+		IncludeExpired: includeExpired,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return resp.Locks, resp.NextPageToken, nil
+}
@@ -0,0 +1,295 @@
+// Package election implements leader election on top of capybara locks.
+//
+// Every candidate campaigns for the same lock key, the one holding the lock
+// being the leader. The lock is kept alive in the background while the
+// leader holds it, and every participant observes the lock to know who the
+// current leader is.
+package election
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	capybara "github.com/depado/capybara/client"
+	"github.com/depado/capybara/pb"
+)
+
+const (
+	// minBackoff is the initial delay before retrying after a transient error.
+	minBackoff = 100 * time.Millisecond
+	// maxBackoff is the maximum delay between retries.
+	maxBackoff = 5 * time.Second
+)
+
+// ErrNotLeader is returned by Resign when the election isn't led by the
+// client.
+var ErrNotLeader = errors.New("not the leader")
+
+// Election is the participation of a client in the election held on a lock
+// key. Use New to create one.
+type Election struct {
+	c   *capybara.Client
+	key string
+	ttl time.Duration
+
+	m          sync.Mutex
+	lock       *capybara.Lock
+	lockCancel context.CancelFunc
+	leader     string
+	changes    chan string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New creates an election on the given lock key and starts observing its
+// leader. Leadership is held with the given ttl, a zero ttl uses the server's
+// default. Close must be called to stop observing.
+func New(c *capybara.Client, key string, ttl time.Duration) *Election {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	e := &Election{
+		c:       c,
+		key:     key,
+		ttl:     ttl,
+		changes: make(chan string, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	go e.observe(ctx)
+
+	return e
+}
+
+// Campaign blocks until the client is elected, or until ctx is done in which
+// case the context's error is returned. Transient connection errors are
+// retried. Once elected, leadership is kept until Resign or Close is called
+// or it is lost, see Lost: ctx only bounds the campaign.
+func (e *Election) Campaign(ctx context.Context) error {
+	e.m.Lock()
+	if e.lock != nil {
+		select {
+		case <-e.lock.Lost():
+			e.lockCancel()
+			e.lock, e.lockCancel = nil, nil
+		default:
+			e.m.Unlock()
+			return nil
+		}
+	}
+	e.m.Unlock()
+
+	backoff := minBackoff
+
+	for {
+		// The lock is kept alive until Resign or Close, ctx only stops the
+		// wait
+		lctx, lcancel := context.WithCancel(e.ctx)
+		stop := context.AfterFunc(ctx, lcancel)
+
+		l, err := e.c.WaitForLock(lctx, e.key, e.ttl)
+		if !stop() {
+			// ctx ended while waiting, the lock is released if it was acquired
+			// in the meantime
+			if err == nil {
+				l.Unlock() //nolint:errcheck
+			}
+			lcancel()
+			return ctx.Err()
+		}
+
+		if err == nil {
+			e.m.Lock()
+			e.lock, e.lockCancel = l, lcancel
+			e.m.Unlock()
+			return nil
+		}
+		lcancel()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !transient(err) {
+			return err
+		}
+
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// Resign gives up leadership. It returns ErrNotLeader if the client isn't
+// the leader, or capybara.ErrLockLost if leadership was already lost.
+func (e *Election) Resign() error {
+	e.m.Lock()
+	l, cancel := e.lock, e.lockCancel
+	e.lock, e.lockCancel = nil, nil
+	e.m.Unlock()
+
+	if l == nil {
+		return ErrNotLeader
+	}
+
+	err := l.Unlock()
+	cancel()
+
+	return err
+}
+
+// Lost returns a channel that is closed when the client loses leadership,
+// or nil if the client isn't the leader.
+func (e *Election) Lost() <-chan struct{} {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if e.lock == nil {
+		return nil
+	}
+
+	return e.lock.Lost()
+}
+
+// Leader returns the identifier of the current leader as last observed, or an
+// empty string if there is none.
+func (e *Election) Leader() string {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	return e.leader
+}
+
+// IsLeader returns whether the client holds the leadership, which it does
+// from the moment Campaign returns until it resigns or loses it.
+func (e *Election) IsLeader() bool {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if e.lock == nil {
+		return false
+	}
+
+	select {
+	case <-e.lock.Lost():
+		return false
+	default:
+		return true
+	}
+}
+
+// Changes returns a channel receiving the identifier of the new leader, or
+// an empty string, whenever leadership changes. Only the latest change is
+// kept if the channel isn't consumed.
+func (e *Election) Changes() <-chan string {
+	return e.changes
+}
+
+// Close stops observing the election and resigns if the client is the
+// leader.
+func (e *Election) Close() error {
+	e.cancel()
+	<-e.done
+
+	if err := e.Resign(); err != nil && !errors.Is(err, ErrNotLeader) {
+		return err
+	}
+
+	return nil
+}
+
+// setLeader records the leader and notifies the change, if any.
+func (e *Election) setLeader(leader string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if leader == e.leader {
+		return
+	}
+	e.leader = leader
+
+	// Replace the pending change, if any, with the latest one
+	select {
+	case <-e.changes:
+	default:
+	}
+	e.changes <- leader
+}
+
+// observe watches the lock to follow the leader until ctx is done. The watch
+// is started again after transient errors.
+func (e *Election) observe(ctx context.Context) {
+	defer close(e.done)
+
+	backoff := minBackoff
+
+	for {
+		err := e.watch(ctx, func() { backoff = minBackoff })
+		if ctx.Err() != nil {
+			return
+		}
+
+		// The leader is unknown until the watch is started again
+		if !transient(err) {
+			e.setLeader("")
+		}
+
+		if sleep(ctx, backoff) != nil {
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// watch follows the lock's events until the stream fails. The started
+// function is called once the stream is established.
+func (e *Election) watch(ctx context.Context, started func()) error {
+	stream, err := e.c.WatchLocks(ctx, e.key, false, true)
+	if err != nil {
+		return err
+	}
+
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if ev.Type == pb.LockEvent_CURRENT {
+			started()
+		}
+		e.setLeader(ev.Lock.GetOwner())
+	}
+}
+
+// transient returns whether the error is worth retrying.
+func transient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+		return true
+	}
+
+	return false
+}
+
+// sleep waits for the given duration, or until ctx is done in which case the
+// context's error is returned.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
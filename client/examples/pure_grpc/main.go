@@ -28,7 +28,7 @@ func main() {
 
 	// Initialize capybara client and set context with a valid token
 	lc := pb.NewCapybaraClient(conn)
-	ctx := metadata.NewOutgoingContext(context.Background(), metadata.New(map[string]string{"token": "valid-token"}))
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.New(map[string]string{"token": os.Getenv("CAPYBARA_TOKEN")}))
 	whoami := uuid.New().String()
 	lock := "hello"
 
@@ -16,7 +16,7 @@ func main() {
 
 	// Initialize the client
 	capy, err := capybara.NewClient("127.0.0.1:8080", capybara.ClientOpts{
-		Token:    "valid-token",
+		Token:    os.Getenv("CAPYBARA_TOKEN"),
 		CertPath: "certs/ca-cert.pem",
 	})
 	if err != nil {
@@ -57,7 +57,7 @@ func main() {
 
 	// Initialize another client that will try and steal the lock
 	second, err := capybara.NewClient("127.0.0.1:8080", capybara.ClientOpts{
-		Token:    "valid-token",
+		Token:    os.Getenv("CAPYBARA_TOKEN"),
 		CertPath: "certs/ca-cert.pem",
 		Who:      "second",
 	})
@@ -0,0 +1,63 @@
+package capybara
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// keepAlive calls refresh at the given interval until ctx is done, and
+// returns true then. refresh returns the new expiration of the hold, which is
+// valid until the given time at first. Failed refreshes are retried more
+// often until the hold expires, unless the error is fatal: false is returned
+// as soon as the hold is lost.
+func keepAlive(ctx context.Context, interval time.Duration, until time.Time, refresh func(context.Context) (time.Time, error)) bool {
+	t := time.NewTimer(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-t.C:
+		}
+
+		rctx, cancel := context.WithTimeout(ctx, interval)
+		next, err := refresh(rctx)
+		cancel()
+
+		if err == nil {
+			until = next
+			t.Reset(interval)
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return true
+		}
+
+		if fatal(err) {
+			return false
+		}
+
+		// Transient error, retry more often while the hold is still valid
+		left := time.Until(until)
+		if left <= 0 {
+			return false
+		}
+		t.Reset(min(interval/4, left))
+	}
+}
+
+// fatal returns whether a refresh error means the hold is lost: the server
+// reports that it is gone or owned by someone else, or rejects the refresh.
+func fatal(err error) bool {
+	switch status.Code(err) {
+	case codes.NotFound, codes.FailedPrecondition, codes.PermissionDenied, codes.InvalidArgument:
+		return true
+	}
+
+	return false
+}
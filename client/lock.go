@@ -0,0 +1,234 @@
+package capybara
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/depado/capybara/pb"
+)
+
+// minRefreshInterval is the minimum interval between the refreshes of a lock
+// claimed with the server's default TTL.
+const minRefreshInterval = 100 * time.Millisecond
+
+// ErrLockLost is returned by Lock.Unlock when the lock was lost before being
+// released.
+var ErrLockLost = errors.New("lock lost")
+
+// HeldError is returned by Lock and RLock when the lock is held by other
+// clients. It wraps ErrLockNotClaimed and describes the holders using the
+// metadata they attached to their claim.
+type HeldError struct {
+	Holders []*pb.Holder
+}
+
+// Error implements the error interface.
+func (e *HeldError) Error() string {
+	holders := make([]string, 0, len(e.Holders))
+	for _, h := range e.Holders {
+		holders = append(holders, describeHolder(h))
+	}
+
+	return fmt.Sprintf("%s: held by %s", ErrLockNotClaimed, strings.Join(holders, ", "))
+}
+
+// Unwrap returns ErrLockNotClaimed.
+func (e *HeldError) Unwrap() error {
+	return ErrLockNotClaimed
+}
+
+// describeHolder returns the owner of the hold followed by its metadata, if
+// any, such as "worker-1 (host web-1, pid 42, job 7: nightly backup)".
+func describeHolder(h *pb.Holder) string {
+	md := h.GetMetadata()
+
+	var details []string
+	if md.GetHostname() != "" {
+		details = append(details, "host "+md.GetHostname())
+	}
+	if md.GetPid() != 0 {
+		details = append(details, fmt.Sprintf("pid %d", md.GetPid()))
+	}
+	if md.GetJobId() != "" {
+		details = append(details, "job "+md.GetJobId())
+	}
+
+	s := h.GetOwner()
+	if len(details) > 0 || md.GetReason() != "" {
+		s += " (" + strings.Join(details, ", ")
+		if md.GetReason() != "" {
+			if len(details) > 0 {
+				s += ": "
+			}
+			s += md.GetReason()
+		}
+		s += ")"
+	}
+
+	return s
+}
+
+// Lock is a lock held by the client. It is refreshed in the background at a
+// third of its TTL until Unlock is called or the context it was acquired with
+// is done, in which case it is released. If the lock can't be refreshed, it
+// is considered lost and the Lost channel is closed.
+type Lock struct {
+	c        Client
+	key      string
+	ttl      time.Duration
+	interval time.Duration
+	resp     *pb.LockResponse
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	lost     chan struct{}
+	lostOnce sync.Once
+	err      error
+}
+
+// Lock claims the given lock and returns a handle that keeps it alive. It
+// returns a HeldError, which wraps ErrLockNotClaimed, if the lock is owned
+// by another client. A zero ttl uses the server's default. Cancelling ctx
+// releases the lock.
+func (c Client) Lock(ctx context.Context, lock string, ttl time.Duration) (*Lock, error) {
+	return c.lock(ctx, lock, ttl, false, false)
+}
+
+// WaitForLock is like Lock but waits for the lock to be released or to expire
+// if it is owned by another client. The wait stops when ctx is done.
+func (c Client) WaitForLock(ctx context.Context, lock string, ttl time.Duration) (*Lock, error) {
+	return c.lock(ctx, lock, ttl, true, false)
+}
+
+// RLock is like Lock but claims a shared lock, which other clients can hold
+// at the same time in shared mode.
+func (c Client) RLock(ctx context.Context, lock string, ttl time.Duration) (*Lock, error) {
+	return c.lock(ctx, lock, ttl, false, true)
+}
+
+// WaitForRLock is like WaitForLock but claims a shared lock.
+func (c Client) WaitForRLock(ctx context.Context, lock string, ttl time.Duration) (*Lock, error) {
+	return c.lock(ctx, lock, ttl, true, true)
+}
+
+// lock claims the lock and starts its keep-alive goroutine.
+func (c Client) lock(ctx context.Context, lock string, ttl time.Duration, wait, shared bool) (*Lock, error) {
+	lr := &pb.LockRequest{Key: lock, Who: c.who, Shared: shared, Metadata: c.md}
+	if ttl != 0 {
+		lr.TTL = durationpb.New(ttl)
+	}
+
+	var resp *pb.LockResponse
+	var err error
+	if wait {
+		resp, err = c.capy.WaitLock(c.withToken(ctx), lr)
+	} else {
+		resp, err = c.capy.ClaimLock(c.withToken(ctx), lr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.Acquired && !heldBy(resp, c.who, shared) {
+		return nil, &HeldError{Holders: resp.Holders}
+	}
+
+	// The refreshes keep using the server's default TTL, its expiry is only
+	// used to pick the refresh interval since the client's clock may differ
+	interval := ttl / 3
+	if ttl == 0 {
+		interval = max(time.Until(validUntil(resp, c.who))/3, minRefreshInterval)
+	}
+
+	lctx, cancel := context.WithCancel(ctx)
+	l := &Lock{
+		c:        c,
+		key:      lock,
+		ttl:      ttl,
+		interval: interval,
+		resp:     resp,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		lost:     make(chan struct{}),
+	}
+
+	go l.keepAlive(lctx)
+
+	return l, nil
+}
+
+// Key returns the key of the lock.
+func (l *Lock) Key() string {
+	return l.key
+}
+
+// FencingToken returns the fencing token the lock was acquired with.
+func (l *Lock) FencingToken() uint64 {
+	for _, h := range l.resp.Holders {
+		if h.Owner == l.c.who {
+			return h.FencingToken
+		}
+	}
+
+	return l.resp.FencingToken
+}
+
+// validUntil returns the expiration of who's hold on the lock.
+func validUntil(pr *pb.LockResponse, who string) time.Time {
+	for _, h := range pr.Holders {
+		if h.Owner == who {
+			return h.ValidUntil.AsTime()
+		}
+	}
+
+	return pr.ValidUntil.AsTime()
+}
+
+// Lost returns a channel that is closed when the lock is lost, either because
+// it expired before it could be refreshed or because it is now owned by
+// another client.
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Unlock stops refreshing the lock and releases it. It returns ErrLockLost if
+// the lock was lost in the meantime. Calling Unlock more than once returns
+// the same result.
+func (l *Lock) Unlock() error {
+	l.cancel()
+	<-l.done
+
+	return l.err
+}
+
+// markLost closes the Lost channel.
+func (l *Lock) markLost() {
+	l.lostOnce.Do(func() { close(l.lost) })
+	l.err = ErrLockLost
+}
+
+// keepAlive refreshes the lock until ctx is done, then releases it. The lock
+// is marked as lost if it can't be refreshed.
+func (l *Lock) keepAlive(ctx context.Context) {
+	defer close(l.done)
+
+	held := keepAlive(ctx, l.interval, validUntil(l.resp, l.c.who), func(rctx context.Context) (time.Time, error) {
+		resp, err := l.c.RefreshLock(rctx, l.key, l.ttl)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return validUntil(resp, l.c.who), nil
+	})
+	if !held {
+		l.markLost()
+		return
+	}
+
+	l.err = l.c.ReleaseLock(l.key)
+}
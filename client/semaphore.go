@@ -0,0 +1,51 @@
+package capybara
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/depado/capybara/pb"
+)
+
+// ErrNoPermit is returned when all the permits of a semaphore are held by
+// other clients.
+var ErrNoPermit = errors.New("no permit available")
+
+// AcquireSemaphore acquires one of the permits of the given semaphore, and
+// returns ErrNoPermit along with the current holders if they are all held. A
+// zero ttl uses the server's default. Acquiring a permit the client already
+// holds delays its expiration. The number of permits must match the one the
+// semaphore is currently held with, an error with the FailedPrecondition code
+// is returned otherwise.
+func (c Client) AcquireSemaphore(ctx context.Context, sem string, permits uint32, ttl time.Duration) (*pb.SemaphoreResponse, error) {
+	sr := &pb.SemaphoreRequest{Key: sem, Who: c.who, Permits: permits}
+	if ttl != 0 {
+		sr.TTL = durationpb.New(ttl)
+	}
+
+	resp, err := c.capy.AcquireSemaphore(c.withToken(ctx), sr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.Acquired {
+		for _, h := range resp.Holders {
+			if h.Owner == c.who {
+				return resp, nil
+			}
+		}
+		return resp, ErrNoPermit
+	}
+
+	return resp, nil
+}
+
+// ReleaseSemaphore releases the permit the client holds on the given
+// semaphore.
+func (c Client) ReleaseSemaphore(ctx context.Context, sem string) error {
+	_, err := c.capy.ReleaseSemaphore(c.withToken(ctx), &pb.ReleaseRequest{Key: sem, Who: c.who})
+	return err
+}
@@ -0,0 +1,150 @@
+package capybara
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/depado/capybara/pb"
+)
+
+// ErrSessionLost is returned by Session.Close when the session expired before
+// being closed.
+var ErrSessionLost = errors.New("session lost")
+
+// Session is a session created by the client. Locks and kv entries attached
+// to it are released and deleted when it is closed or lost. It is kept alive
+// in the background at a third of its TTL until Close is called or the
+// context it was created with is done, in which case it is closed. If it
+// can't be kept alive, it is considered lost and the Lost channel is closed.
+type Session struct {
+	c      Client
+	sess   *pb.Session
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	lost     chan struct{}
+	lostOnce sync.Once
+	err      error
+}
+
+// NewSession creates a session and returns a handle that keeps it alive. A
+// zero ttl uses the server's default. Cancelling ctx closes the session.
+func (c Client) NewSession(ctx context.Context, ttl time.Duration) (*Session, error) {
+	sr := &pb.CreateSessionRequest{Who: c.who}
+	if ttl != 0 {
+		sr.TTL = durationpb.New(ttl)
+	}
+
+	sess, err := c.capy.CreateSession(c.withToken(ctx), sr)
+	if err != nil {
+		return nil, err
+	}
+
+	sctx, cancel := context.WithCancel(ctx)
+	s := &Session{
+		c:      c,
+		sess:   sess,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		lost:   make(chan struct{}),
+	}
+
+	go s.keepAlive(sctx)
+
+	return s, nil
+}
+
+// ID returns the identifier of the session.
+func (s *Session) ID() string {
+	return s.sess.Id
+}
+
+// ClaimLock claims the given lock and attaches it to the session, returning
+// ErrLockNotClaimed if it is owned by another client.
+func (s *Session) ClaimLock(ctx context.Context, lock string) (*pb.LockResponse, error) {
+	pr, err := s.c.capy.ClaimLock(s.c.withToken(ctx), &pb.LockRequest{Key: lock, Who: s.c.who, Metadata: s.c.md, Session: s.sess.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	if !pr.Acquired && !heldBy(pr, s.c.who, false) {
+		return pr, ErrLockNotClaimed
+	}
+
+	return pr, nil
+}
+
+// ClaimLocks claims several locks atomically like Client.ClaimLocks does, and
+// attaches them to the session.
+func (s *Session) ClaimLocks(ctx context.Context, locks []string) ([]*pb.LockInfo, error) {
+	pr, err := s.c.capy.ClaimLocks(s.c.withToken(ctx), &pb.LocksRequest{Keys: locks, Who: s.c.who, Metadata: s.c.md, Session: s.sess.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	if !pr.Acquired {
+		return pr.Locks, ErrLockNotClaimed
+	}
+
+	return pr.Locks, nil
+}
+
+// Put puts a value at the given key in the given buckets. The key is deleted
+// when the session ends, unless it is written again without the session in
+// the meantime.
+func (s *Session) Put(ctx context.Context, buckets []string, key string, value []byte) error {
+	_, err := s.c.capy.Put(s.c.withToken(ctx), &pb.PutRequest{Buckets: buckets, Key: key, Value: value, Session: s.sess.Id, Who: s.c.who})
+	return err
+}
+
+// Lost returns a channel that is closed when the session is lost, because it
+// expired before it could be kept alive.
+func (s *Session) Lost() <-chan struct{} {
+	return s.lost
+}
+
+// Close stops keeping the session alive and closes it. It returns
+// ErrSessionLost if the session was lost in the meantime. Calling Close more
+// than once returns the same result.
+func (s *Session) Close() error {
+	s.cancel()
+	<-s.done
+
+	return s.err
+}
+
+// markLost closes the Lost channel.
+func (s *Session) markLost() {
+	s.lostOnce.Do(func() { close(s.lost) })
+	s.err = ErrSessionLost
+}
+
+// closeSession closes the session on the server.
+func (s *Session) closeSession() error {
+	_, err := s.c.capy.CloseSession(s.c.ctx, &pb.SessionRequest{Id: s.sess.Id, Who: s.c.who})
+	return err
+}
+
+// keepAlive keeps the session alive until ctx is done, then closes it. The
+// session is marked as lost if it can't be kept alive.
+func (s *Session) keepAlive(ctx context.Context) {
+	defer close(s.done)
+
+	held := keepAlive(ctx, s.sess.Ttl.AsDuration()/3, s.sess.ValidUntil.AsTime(), func(rctx context.Context) (time.Time, error) {
+		sess, err := s.c.capy.KeepAliveSession(s.c.withToken(rctx), &pb.SessionRequest{Id: s.sess.Id, Who: s.c.who})
+		if err != nil {
+			return time.Time{}, err
+		}
+		return sess.ValidUntil.AsTime(), nil
+	})
+	if !held {
+		s.markLost()
+		return
+	}
+
+	s.err = s.closeSession()
+}
@@ -0,0 +1,47 @@
+package capybara
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/depado/capybara/pb"
+)
+
+// CreateToken creates a new token with the given name and scopes. A ttl of
+// zero creates a token that never expires. The returned secret is the only
+// copy of the token, the server only stores its hash.
+// This call requires the client to use an admin token.
+func (c Client) CreateToken(name string, ttl time.Duration, admin bool, scopes ...string) (string, *pb.Token, error) {
+	tr := &pb.CreateTokenRequest{Name: name, Admin: admin, Scopes: scopes}
+	if ttl > 0 {
+		tr.TTL = durationpb.New(ttl)
+	}
+
+	resp, err := c.capy.CreateToken(c.ctx, tr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return resp.Secret, resp.Token, nil
+}
+
+// RevokeToken revokes the token with the given name. A revoked token is
+// immediately rejected by the server.
+// This call requires the client to use an admin token.
+func (c Client) RevokeToken(name string) error {
+	_, err := c.capy.RevokeToken(c.ctx, &pb.RevokeTokenRequest{Name: name})
+	return err
+}
+
+// ListTokens lists the tokens known to the server, including the expired and
+// revoked ones.
+// This call requires the client to use an admin token.
+func (c Client) ListTokens() ([]*pb.Token, error) {
+	resp, err := c.capy.ListTokens(c.ctx, &pb.ListTokensRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Tokens, nil
+}
@@ -1,10 +1,12 @@
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
@@ -19,21 +21,157 @@ var certGenCmd = &cobra.Command{
 	Use:   "gen",
 	Short: "Generate a new certificate ready to use",
 	Run: func(cmd *cobra.Command, args []string) {
-		conf, err := NewConf()
-		if err != nil {
-			l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-			l.Fatal().Err(err).Msg("unable to parse configuration")
-		}
-		l := NewLogger(conf)
+		conf, l := mustConf()
 		if err := GenerateServerCertEd(conf, l, true); err != nil {
 			l.Fatal().Err(err).Msg("unable to generate server cert")
 		}
 	},
 }
 
+var certGenServerCmd = &cobra.Command{
+	Use:   "server",
+	Short: "Issue an additional server certificate signed by the existing CA",
+	Run: func(cmd *cobra.Command, args []string) {
+		runCertIssue(cmd, false)
+	},
+}
+
+var certGenClientCmd = &cobra.Command{
+	Use:   "client",
+	Short: "Issue a client certificate signed by the existing CA, for mtls",
+	Run: func(cmd *cobra.Command, args []string) {
+		runCertIssue(cmd, true)
+	},
+}
+
 var certCheckCmd = &cobra.Command{
 	Use:   "check",
 	Short: "Check certificates",
+	Long: `Check that the certificate matches its private key, was signed by the CA
+and isn't about to expire. Exits with a non-zero status if a problem is found.
+The server's certificate is checked unless --cert and --key are given.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		conf, l := mustConf()
+
+		certPath, _ := cmd.Flags().GetString("cert")
+		keyPath, _ := cmd.Flags().GetString("key")
+		caPath, _ := cmd.Flags().GetString("ca-cert")
+		warnDays, _ := cmd.Flags().GetInt("warn-days")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		if certPath == "" {
+			certPath = conf.Server.TLS.CertPath
+		}
+
+		if keyPath == "" {
+			keyPath = conf.Server.TLS.KeyPath
+		}
+
+		if caPath == "" {
+			caPath = conf.Server.TLS.CAPath
+		}
+
+		r := CheckCert(certPath, keyPath, caPath, time.Duration(warnDays)*24*time.Hour)
+
+		if asJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(r); err != nil {
+				l.Fatal().Err(err).Msg("unable to encode report")
+			}
+		} else {
+			printCertReport(r)
+		}
+
+		if !r.OK {
+			os.Exit(1)
+		}
 	},
 }
+
+// printCertReport prints the report in a human readable way.
+func printCertReport(r CertReport) {
+	fmt.Printf("Certificate: %s\nKey: %s\nCA: %s\n", r.CertPath, r.KeyPath, r.CAPath)
+	if r.Subject != "" {
+		fmt.Printf("Subject: %s\nIssuer: %s\n", r.Subject, r.Issuer)
+		fmt.Printf("DNS names: %s\nIP addresses: %s\n", strings.Join(r.DNSNames, ", "), strings.Join(r.IPAddresses, ", "))
+		fmt.Printf("Valid: %s to %s (%d days remaining)\n",
+			r.NotBefore.Format(time.RFC3339), r.NotAfter.Format(time.RFC3339), r.DaysRemaining)
+	}
+	fmt.Printf("Key matches: %t\nChain valid: %t\n", r.KeyMatch, r.ChainValid)
+	for _, p := range r.Problems {
+		fmt.Printf("Problem: %s\n", p)
+	}
+}
+
+// runCertIssue issues a server or client certificate using the flags of the
+// given command.
+func runCertIssue(cmd *cobra.Command, client bool) {
+	conf, l := mustConf()
+
+	cn, _ := cmd.Flags().GetString("cn")
+	dns, _ := cmd.Flags().GetStringSlice("dns")
+	ips, _ := cmd.Flags().GetIPSlice("ip")
+	validity, _ := cmd.Flags().GetDuration("validity")
+	certPath, _ := cmd.Flags().GetString("cert")
+	keyPath, _ := cmd.Flags().GetString("key")
+	caCertPath, _ := cmd.Flags().GetString("ca-cert")
+	caKeyPath, _ := cmd.Flags().GetString("ca-key")
+
+	// Clients verify the server's hostname against its subject alternative
+	// names, a server certificate without any is unusable
+	if !client && len(dns) == 0 && len(ips) == 0 {
+		l.Fatal().Msg("a server certificate requires at least one --dns or --ip")
+	}
+
+	if cn == "" && !client {
+		if len(dns) > 0 {
+			cn = dns[0]
+		} else {
+			cn = ips[0].String()
+		}
+	}
+
+	if cn == "" {
+		l.Fatal().Msg("a common name is required")
+	}
+
+	if validity <= 0 {
+		l.Fatal().Msg("validity must be positive")
+	}
+
+	if caCertPath == "" {
+		caCertPath = conf.Server.TLS.CAPath
+	}
+
+	if certPath == "" {
+		certPath = fmt.Sprintf("certs/%s-cert.pem", certFileName(cn))
+	}
+
+	if keyPath == "" {
+		keyPath = fmt.Sprintf("certs/%s-key.pem", certFileName(cn))
+	}
+
+	caCert, caKey, err := LoadCA(caCertPath, caKeyPath)
+	if err != nil {
+		l.Fatal().Err(err).Msg("unable to load CA")
+	}
+
+	opts := CertOpts{
+		CommonName: cn,
+		DNSNames:   dns,
+		IPs:        ips,
+		Validity:   validity,
+		Client:     client,
+		CertPath:   certPath,
+		KeyPath:    keyPath,
+	}
+
+	if err := IssueCertEd(caCert, caKey, opts, l); err != nil {
+		l.Fatal().Err(err).Msg("unable to issue certificate")
+	}
+}
+
+// certFileName returns the common name as used in the default file names of
+// a certificate, without spaces or path separators.
+func certFileName(cn string) string {
+	return strings.NewReplacer(" ", "-", "/", "-", "\\", "-").Replace(cn)
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// CertReport is the result of a certificate check.
+type CertReport struct {
+	CertPath      string    `json:"cert_path"`
+	KeyPath       string    `json:"key_path"`
+	CAPath        string    `json:"ca_path"`
+	Subject       string    `json:"subject,omitempty"`
+	Issuer        string    `json:"issuer,omitempty"`
+	DNSNames      []string  `json:"dns_names,omitempty"`
+	IPAddresses   []string  `json:"ip_addresses,omitempty"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	DaysRemaining int       `json:"days_remaining"`
+	KeyMatch      bool      `json:"key_match"`
+	ChainValid    bool      `json:"chain_valid"`
+	Problems      []string  `json:"problems,omitempty"`
+	OK            bool      `json:"ok"`
+}
+
+// problem records a problem found during the check.
+func (r *CertReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// CheckCert loads the certificate, its private key and the CA, and checks
+// that the key matches the certificate, that the certificate was signed by
+// the CA and that it doesn't expire within the warn duration.
+func CheckCert(certPath, keyPath, caPath string, warn time.Duration) (r CertReport) {
+	r = CertReport{CertPath: certPath, KeyPath: keyPath, CAPath: caPath}
+	defer func() { r.OK = len(r.Problems) == 0 }()
+
+	b, err := readPEM(certPath, "CERTIFICATE")
+	if err != nil {
+		r.problem("load certificate: %s", err)
+		return r
+	}
+
+	cert, err := x509.ParseCertificate(b)
+	if err != nil {
+		r.problem("parse certificate: %s", err)
+		return r
+	}
+
+	r.Subject = cert.Subject.String()
+	r.Issuer = cert.Issuer.String()
+	r.DNSNames = cert.DNSNames
+	for _, ip := range cert.IPAddresses {
+		r.IPAddresses = append(r.IPAddresses, ip.String())
+	}
+	r.NotBefore = cert.NotBefore
+	r.NotAfter = cert.NotAfter
+	r.DaysRemaining = int(time.Until(cert.NotAfter).Hours() / 24)
+
+	// LoadX509KeyPair checks that the private key matches the certificate
+	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		r.problem("key pair: %s", err)
+	} else {
+		r.KeyMatch = true
+	}
+
+	if ca, err := readPEM(caPath, "CERTIFICATE"); err != nil {
+		r.problem("load CA: %s", err)
+	} else if caCert, err := x509.ParseCertificate(ca); err != nil {
+		r.problem("parse CA: %s", err)
+	} else {
+		roots := x509.NewCertPool()
+		roots.AddCert(caCert)
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			r.problem("verify chain: %s", err)
+		} else {
+			r.ChainValid = true
+		}
+	}
+
+	switch now := time.Now(); {
+	case now.After(cert.NotAfter):
+		r.problem("certificate expired on %s", cert.NotAfter.Format(time.RFC3339))
+	case now.Before(cert.NotBefore):
+		r.problem("certificate isn't valid before %s", cert.NotBefore.Format(time.RFC3339))
+	case now.Add(warn).After(cert.NotAfter):
+		r.problem("certificate expires in %d days", r.DaysRemaining)
+	}
+
+	return r
+}
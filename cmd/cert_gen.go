@@ -1,11 +1,13 @@
 package cmd
 
 import (
+	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
@@ -16,194 +18,247 @@ import (
 	"github.com/rs/zerolog"
 )
 
-// GenerateServerCertEd will generate a new certificate and private key. This
-// function will return an error if a key or a cert already exist as to avoid
-// any data loss.
-func GenerateServerCertEd(c *Conf, log zerolog.Logger, local bool) error {
-	var caCertPath, caKeyPath = "certs/ca-cert.pem", "certs/ca-key.pem"
+// CertOpts holds the options used to issue a certificate signed by the CA.
+type CertOpts struct {
+	CommonName string
+	DNSNames   []string
+	IPs        []net.IP
+	Validity   time.Duration
+	Client     bool
+	CertPath   string
+	KeyPath    string
+}
 
-	// Create directories if needed
-	if err := os.MkdirAll(filepath.Dir(c.Server.TLS.CertPath), os.ModePerm); err != nil {
-		return fmt.Errorf("create directory: %w", err)
+// checkAbsent returns an error if any of the given files already exist.
+func checkAbsent(paths ...string) error {
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return fmt.Errorf("file already exists: %s", p)
+		}
 	}
 
-	if err := os.MkdirAll(filepath.Dir(c.Server.TLS.KeyPath), os.ModePerm); err != nil {
+	return nil
+}
+
+// writePEM encodes the given bytes as a PEM block of the given type and writes
+// it to path, creating the directories if needed.
+func writePEM(path, typ string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
 		return fmt.Errorf("create directory: %w", err)
 	}
 
-	// Error if cert or pk are already present
-	if _, err := os.Stat(c.Server.TLS.CertPath); err == nil {
-		return fmt.Errorf("file already exists: %s", c.Server.TLS.CertPath)
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("create file: %s: %w", path, err)
 	}
+	defer fd.Close() //nolint:errcheck
 
-	if _, err := os.Stat(c.Server.TLS.KeyPath); err == nil {
-		return fmt.Errorf("file already exists: %s", c.Server.TLS.KeyPath)
+	if err = pem.Encode(fd, &pem.Block{Type: typ, Bytes: b}); err != nil {
+		return fmt.Errorf("pem encode: %s: %w", path, err)
 	}
 
-	if _, err := os.Stat(caCertPath); err == nil {
-		return fmt.Errorf("file already exists: %s", caCertPath)
-	}
+	return nil
+}
 
-	if _, err := os.Stat(caKeyPath); err == nil {
-		return fmt.Errorf("file already exists: %s", caKeyPath)
+// writeKey writes the private key to path in PKCS8 format.
+func writeKey(path string, key crypto.PrivateKey) error {
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("marshal private key: %w", err)
 	}
 
-	// Dummy certificate authority
-	caCert := &x509.Certificate{
-		SerialNumber: big.NewInt(2022),
-		Subject: pkix.Name{
-			Organization: []string{"Capybara Ltd."},
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
-		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
-	}
+	return writePEM(path, "PRIVATE KEY", b)
+}
 
-	// Generate a new private key
-	caPub, caPriv, err := ed25519.GenerateKey(rand.Reader)
+// readPEM reads the first PEM block of the given type in the file.
+func readPEM(path, typ string) ([]byte, error) {
+	raw, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("generate key: %w", err)
+		return nil, fmt.Errorf("read file: %w", err)
 	}
 
-	log.Info().Msg("generated CA ed25519 private key")
+	for {
+		var block *pem.Block
+		if block, raw = pem.Decode(raw); block == nil {
+			return nil, fmt.Errorf("%s: no %s pem block", path, typ)
+		}
+		if block.Type == typ {
+			return block.Bytes, nil
+		}
+	}
+}
 
-	// Generate a new x509 cert with the previously created CA and private key
-	caBytes, err := x509.CreateCertificate(rand.Reader, caCert, caCert, caPub, caPriv)
+// LoadCA loads the CA certificate and its private key.
+func LoadCA(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	b, err := readPEM(certPath, "CERTIFICATE")
 	if err != nil {
-		return fmt.Errorf("generate certificate: %w", err)
+		return nil, nil, err
 	}
 
-	log.Info().Msg("generated CA certificate with ed25519 private key")
-
-	// Write the cert to the configured path
-	fdca, err := os.OpenFile(caCertPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	cert, err := x509.ParseCertificate(b)
 	if err != nil {
-		return fmt.Errorf("create file: %s: %w", caCertPath, err)
+		return nil, nil, fmt.Errorf("parse CA certificate: %w", err)
 	}
-	defer fdca.Close() //nolint:errcheck
 
-	if err = pem.Encode(fdca, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: caBytes,
-	}); err != nil {
-		return fmt.Errorf("pem encode cert: %w", err)
+	if !cert.IsCA {
+		return nil, nil, fmt.Errorf("%s is not a CA certificate", certPath)
 	}
 
-	log.Info().Str("file", c.Server.TLS.CertPath).Msg("wrote certificate to file")
-
-	// Write the private key to the configured path
-	fdk, err := os.OpenFile(caKeyPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
-	if err != nil {
-		return fmt.Errorf("create file: %s: %w", caKeyPath, err)
+	if b, err = readPEM(keyPath, "PRIVATE KEY"); err != nil {
+		return nil, nil, err
 	}
-	defer fdk.Close() //nolint:errcheck
 
-	b, err := x509.MarshalPKCS8PrivateKey(caPriv)
+	k, err := x509.ParsePKCS8PrivateKey(b)
 	if err != nil {
-		return fmt.Errorf("marshal private key: %w", err)
+		return nil, nil, fmt.Errorf("parse CA private key: %w", err)
 	}
 
-	if err = pem.Encode(fdk, &pem.Block{Type: "PRIVATE KEY", Bytes: b}); err != nil {
-		return fmt.Errorf("write file: %s: %w", caKeyPath, err)
+	key, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("CA private key can't sign")
 	}
 
-	log.Info().Str("file", caKeyPath).Msg("wrote private key to file")
+	return cert, key, nil
+}
 
-	// Generate server key and CSR
-	servPub, servPriv, err := ed25519.GenerateKey(rand.Reader)
+// randomSerial returns a random serial number for a new certificate.
+func randomSerial() (*big.Int, error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
 	if err != nil {
-		return fmt.Errorf("generate ed25519 key: %w", err)
+		return nil, fmt.Errorf("generate serial: %w", err)
 	}
 
-	log.Info().Msg("generated server ed25519 private key")
+	return n, nil
+}
 
-	template := x509.CertificateRequest{
-		Subject: pkix.Name{
-			CommonName: "Capybara Server",
-		},
-		SignatureAlgorithm: x509.PureEd25519,
+// IssueCertEd generates a new ed25519 key and a certificate signed by the
+// given CA, for a server or a client depending on the options. This function
+// will return an error if the key or cert files already exist as to avoid any
+// data loss.
+func IssueCertEd(caCert *x509.Certificate, caKey crypto.Signer, opts CertOpts, log zerolog.Logger) error {
+	if err := checkAbsent(opts.CertPath, opts.KeyPath); err != nil {
+		return err
 	}
 
-	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &template, servPriv)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
-		return fmt.Errorf("generate csr: %w", err)
+		return fmt.Errorf("generate ed25519 key: %w", err)
 	}
 
-	csr, err := x509.ParseCertificateRequest(csrBytes)
+	serial, err := randomSerial()
 	if err != nil {
-		return fmt.Errorf("parse csr: %w", err)
+		return err
 	}
 
-	log.Info().Msg("generated server csr")
-
-	clientCRTTemplate := x509.Certificate{
-		Signature:          csr.Signature,
-		SignatureAlgorithm: csr.SignatureAlgorithm,
-
-		PublicKeyAlgorithm: csr.PublicKeyAlgorithm,
-		PublicKey:          csr.PublicKey,
+	usage := x509.ExtKeyUsageServerAuth
+	if opts.Client {
+		usage = x509.ExtKeyUsageClientAuth
+	}
 
-		SerialNumber: big.NewInt(2),
-		Issuer:       caCert.Subject,
-		Subject:      csr.Subject,
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: opts.CommonName},
+		DNSNames:     opts.DNSNames,
+		IPAddresses:  opts.IPs,
 		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(10, 0, 0),
+		NotAfter:     time.Now().Add(opts.Validity),
 		KeyUsage:     x509.KeyUsageDigitalSignature,
-		ExtKeyUsage: []x509.ExtKeyUsage{
-			x509.ExtKeyUsageClientAuth,
-			x509.ExtKeyUsageServerAuth,
-		},
-	}
-
-	if local {
-		clientCRTTemplate.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
 	}
 
-	// Sign CSR with CA private key
-	clientCRTRaw, err := x509.CreateCertificate(rand.Reader, &clientCRTTemplate, caCert, servPub, caPriv)
+	raw, err := x509.CreateCertificate(rand.Reader, template, caCert, pub, caKey)
 	if err != nil {
 		return fmt.Errorf("create crt: %w", err)
 	}
 
-	log.Info().Msg("signed csr with CA ed25519 private key")
+	log.Info().Str("cn", opts.CommonName).Bool("client", opts.Client).
+		Time("not_after", template.NotAfter).Msg("signed certificate with CA private key")
 
-	// Write cert on disk
-	fdcrt, err := os.OpenFile(c.Server.TLS.CertPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
-	if err != nil {
-		return fmt.Errorf("create file: %s: %w", c.Server.TLS.CertPath, err)
+	if err := writePEM(opts.CertPath, "CERTIFICATE", raw); err != nil {
+		return err
 	}
-	defer fdcrt.Close() //nolint:errcheck
 
-	err = pem.Encode(fdcrt, &pem.Block{Type: "CERTIFICATE", Bytes: clientCRTRaw})
-	if err != nil {
-		return fmt.Errorf("pem encode crt: %w", err)
+	log.Info().Str("file", opts.CertPath).Msg("wrote certificate to file")
+
+	if err := writeKey(opts.KeyPath, priv); err != nil {
+		return err
+	}
+
+	log.Info().Str("file", opts.KeyPath).Msg("wrote ed25519 private key to file")
+
+	return nil
+}
+
+// GenerateServerCertEd will generate a new certificate and private key. This
+// function will return an error if a key or a cert already exist as to avoid
+// any data loss.
+func GenerateServerCertEd(c *Conf, log zerolog.Logger, local bool) error {
+	var caCertPath, caKeyPath = c.Server.TLS.CAPath, "certs/ca-key.pem"
+
+	// Error if cert or pk are already present
+	if err := checkAbsent(c.Server.TLS.CertPath, c.Server.TLS.KeyPath, caCertPath, caKeyPath); err != nil {
+		return err
 	}
 
-	log.Info().Str("file", c.Server.TLS.CertPath).Msg("wrote server certificate to file")
+	// Dummy certificate authority
+	caCert := &x509.Certificate{
+		SerialNumber: big.NewInt(2022),
+		Subject: pkix.Name{
+			Organization: []string{"Capybara Ltd."},
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
 
-	// Write private key on disk
-	fdks, err := os.OpenFile(c.Server.TLS.KeyPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	// Generate a new private key
+	caPub, caPriv, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
-		return fmt.Errorf("create file: %s: %w", c.Server.TLS.KeyPath, err)
+		return fmt.Errorf("generate key: %w", err)
 	}
-	defer fdks.Close() //nolint:errcheck
 
-	b, err = x509.MarshalPKCS8PrivateKey(servPriv)
+	log.Info().Msg("generated CA ed25519 private key")
+
+	// Generate a new x509 cert with the previously created CA and private key
+	caBytes, err := x509.CreateCertificate(rand.Reader, caCert, caCert, caPub, caPriv)
 	if err != nil {
-		return fmt.Errorf("marshal server private key: %w", err)
+		return fmt.Errorf("generate certificate: %w", err)
+	}
+
+	log.Info().Msg("generated CA certificate with ed25519 private key")
+
+	if caCert, err = x509.ParseCertificate(caBytes); err != nil {
+		return fmt.Errorf("parse certificate: %w", err)
 	}
 
-	if err = pem.Encode(fdks, &pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: b,
-	}); err != nil {
-		return fmt.Errorf("pem encode key: %w", err)
+	// Write the cert to the configured path
+	if err := writePEM(caCertPath, "CERTIFICATE", caBytes); err != nil {
+		return err
 	}
 
-	log.Info().Str("file", c.Server.TLS.KeyPath).Msg("wrote server ed25519 private key to file")
+	log.Info().Str("file", caCertPath).Msg("wrote certificate to file")
 
-	return nil
+	// Write the private key to the configured path
+	if err := writeKey(caKeyPath, caPriv); err != nil {
+		return err
+	}
+
+	log.Info().Str("file", caKeyPath).Msg("wrote private key to file")
+
+	// Issue the server certificate with the new CA
+	opts := CertOpts{
+		CommonName: "Capybara Server",
+		Validity:   time.Until(time.Now().AddDate(10, 0, 0)),
+		CertPath:   c.Server.TLS.CertPath,
+		KeyPath:    c.Server.TLS.KeyPath,
+	}
+
+	if local {
+		opts.IPs = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+
+	return IssueCertEd(caCert, caPriv, opts, log)
 }
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
@@ -27,11 +28,22 @@ type ServerConf struct {
 	TLS  TLSConfig `mapstructure:"tls"`
 }
 
-// TLSConfig represents the TLS configuration of the service.
+// TLS modes supported by the server.
+const (
+	TLSDisable = "disable"
+	TLSServer  = "server"
+	TLSMutual  = "mtls"
+)
+
+// TLSConfig represents the TLS configuration of the service. With CertAuth,
+// clients that connect using mtls without a token are authenticated with the
+// non-admin token named after the common name of their certificate.
 type TLSConfig struct {
 	CertPath string `mapstructure:"cert_path"`
 	KeyPath  string `mapstructure:"key_path"`
-	Type     string `mapstructure:"tls"`
+	CAPath   string `mapstructure:"ca_path"`
+	Type     string `mapstructure:"type"`
+	CertAuth bool   `mapstructure:"cert_auth"`
 }
 
 // ListenAddr returns a formatted string to listen on.
@@ -49,6 +61,35 @@ type DatabaseConf struct {
 	Path                string        `mapstructure:"path"`
 	MaxBucketsRecursion int           `mapstructure:"max_buckets_recursion"`
 	DefaultLockTTL      time.Duration `mapstructure:"default_lock_ttl"`
+	MinLockTTL          time.Duration `mapstructure:"min_lock_ttl"`
+	MaxLockTTL          time.Duration `mapstructure:"max_lock_ttl"`
+	LockSweepInterval   time.Duration `mapstructure:"lock_sweep_interval"`
+}
+
+// TokenConf represents a token declared in the configuration file. Only the
+// sha256 hash of the secret is stored, see the "token gen" command.
+type TokenConf struct {
+	Name      string    `mapstructure:"name"`
+	Hash      string    `mapstructure:"hash"`
+	ExpiresAt time.Time `mapstructure:"expires_at"`
+	Admin     bool      `mapstructure:"admin"`
+	Scopes    []string  `mapstructure:"scopes"`
+}
+
+// AuthConf represents the authentication configuration.
+type AuthConf struct {
+	Tokens []TokenConf `mapstructure:"tokens"`
+}
+
+// ClientConf represents the configuration used by the commands that connect
+// to a running capybara server.
+type ClientConf struct {
+	Addr     string `mapstructure:"addr"`
+	Token    string `mapstructure:"token"`
+	CAPath   string `mapstructure:"ca_path"`
+	CertPath string `mapstructure:"cert_path"`
+	KeyPath  string `mapstructure:"key_path"`
+	Insecure bool   `mapstructure:"insecure"`
 }
 
 // Conf holds the various configuration structures and is used to parse the
@@ -57,6 +98,8 @@ type Conf struct {
 	Log      LogConf      `mapstructure:"log"`
 	Server   ServerConf   `mapstructure:"server"`
 	Database DatabaseConf `mapstructure:"database"`
+	Auth     AuthConf     `mapstructure:"auth"`
+	Client   ClientConf   `mapstructure:"client"`
 }
 
 // NewLogger will return a new logger.
@@ -115,7 +158,12 @@ func NewConf() (*Conf, error) {
 	viper.ReadInConfig() // nolint: errcheck
 
 	conf := &Conf{}
-	if err := viper.Unmarshal(conf); err != nil {
+	hook := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+	))
+	if err := viper.Unmarshal(conf, hook); err != nil {
 		return conf, fmt.Errorf("unable to unmarshal conf: %w", err)
 	}
 
@@ -131,3 +179,15 @@ func NewConf() (*Conf, error) {
 
 	return conf, nil
 }
+
+// mustConf parses the configuration and returns it along with a logger,
+// exiting if the configuration can't be parsed.
+func mustConf() (*Conf, zerolog.Logger) {
+	conf, err := NewConf()
+	if err != nil {
+		l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		l.Fatal().Err(err).Msg("unable to parse configuration")
+	}
+
+	return conf, NewLogger(conf)
+}
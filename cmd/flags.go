@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"net"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -19,14 +20,69 @@ func addServerFlags(c *cobra.Command) {
 	c.PersistentFlags().Int("server.port", 8080, "port on which the server should listen")
 	c.PersistentFlags().String("server.tls.cert_path", "certs/server-cert.pem", "path to the server TLS certificate")
 	c.PersistentFlags().String("server.tls.key_path", "certs/server-key.pem", "path to the certificate's private key")
+	c.PersistentFlags().String("server.tls.ca_path", "certs/ca-cert.pem", "path to the CA certificate used to verify clients in mtls mode")
 	c.PersistentFlags().String("server.tls.type", "server", `one of "disable", "server", "mtls"`)
+	c.PersistentFlags().Bool("server.tls.cert_auth", false, "in mtls mode, authenticate clients sending no token with the non-admin token named after their certificate's common name")
 }
 
 // addDatabaseFlags will add the database related flags and conf.
 func addDatabaseFlags(c *cobra.Command) {
 	c.PersistentFlags().String("database.path", "capybara.db", "path to the database file to use")
 	c.PersistentFlags().Duration("database.default_lock_ttl", 5*time.Minute, "default time to live for locks")
+	c.PersistentFlags().Duration("database.min_lock_ttl", time.Second, "minimum time to live a client can request for a lock")
+	c.PersistentFlags().Duration("database.max_lock_ttl", 24*time.Hour, "maximum time to live a client can request for a lock")
 	c.PersistentFlags().Int("database.max_buckets_recursion", 3, "maximum recursion of buckets in database")
+	c.PersistentFlags().Duration("database.lock_sweep_interval", time.Minute, "interval at which expired locks, sessions and keys are deleted, 0 disables it")
+}
+
+// addClientFlags adds support to configure how commands connect to a running
+// capybara server.
+func addClientFlags(c *cobra.Command) {
+	c.PersistentFlags().String("client.addr", "127.0.0.1:8080", "address of the capybara server to connect to")
+	c.PersistentFlags().String("client.token", "", "token used to authenticate against the server")
+	c.PersistentFlags().String("client.ca_path", "certs/ca-cert.pem", "path to the server's CA certificate")
+	c.PersistentFlags().String("client.cert_path", "", "path to the client certificate used for mtls")
+	c.PersistentFlags().String("client.key_path", "", "path to the client certificate's private key")
+	c.PersistentFlags().Bool("client.insecure", false, `connect without TLS, to a server whose server.tls.type is "disable"`)
+}
+
+// addCertIssueFlags adds the flags used to issue a certificate from the CA.
+func addCertIssueFlags(c *cobra.Command) {
+	c.Flags().String("cn", "", "common name of the certificate, defaults to the first DNS name or IP address of a server certificate")
+	c.Flags().StringSlice("dns", nil, "DNS names the certificate is valid for")
+	c.Flags().IPSlice("ip", []net.IP{}, "IP addresses the certificate is valid for")
+	c.Flags().Duration("validity", 365*24*time.Hour, "validity of the certificate")
+	c.Flags().String("cert", "", `output path of the certificate, defaults to "certs/<cn>-cert.pem"`)
+	c.Flags().String("key", "", `output path of the private key, defaults to "certs/<cn>-key.pem"`)
+	c.Flags().String("ca-cert", "", "path to the CA certificate, defaults to server.tls.ca_path")
+	c.Flags().String("ca-key", "certs/ca-key.pem", "path to the CA private key")
+}
+
+// addCertCheckFlags adds the flags used to check a certificate.
+func addCertCheckFlags(c *cobra.Command) {
+	c.Flags().String("cert", "", "path to the certificate to check, defaults to server.tls.cert_path")
+	c.Flags().String("key", "", "path to the certificate's private key, defaults to server.tls.key_path")
+	c.Flags().String("ca-cert", "", "path to the CA certificate, defaults to server.tls.ca_path")
+	c.Flags().Int("warn-days", 14, "fail if the certificate expires within this number of days")
+	c.Flags().Bool("json", false, "output the report as json")
+}
+
+// addTokenCreateFlags adds the flags used when creating a new token.
+func addTokenCreateFlags(c *cobra.Command) {
+	c.Flags().Duration("ttl", 0, "validity of the token, never expires if zero")
+	c.Flags().Bool("admin", false, "allow the token to manage other tokens and bypass scopes")
+	c.Flags().StringArray("scope", nil, `scope granted to the token, as "<kv|lock|semaphore>:<r|rw|admin>:<pattern>"`)
+}
+
+// addLockInspectFlags adds the flags used when inspecting locks.
+func addLockInspectFlags(c *cobra.Command) {
+	c.Flags().Bool("expired", false, "include the expired locks and holders")
+}
+
+// addLockForceReleaseFlags adds the flags used when forcing a lock release.
+func addLockForceReleaseFlags(c *cobra.Command) {
+	c.Flags().String("owner", "", "only release this holder of the lock")
+	c.Flags().String("reason", "", "why the release is forced, recorded in the server logs")
 }
 
 // addConfigurationFlag adds support to provide a configuration file on the
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Inspect and manage the locks of a running server",
+	Run: func(cmd *cobra.Command, args []string) {
+	},
+}
+
+var lockListCmd = &cobra.Command{
+	Use:   "list [prefix]",
+	Short: "List the locks whose key starts with the given prefix",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, l := mustConf()
+
+		expired, _ := cmd.Flags().GetBool("expired")
+
+		var prefix string
+		if len(args) > 0 {
+			prefix = args[0]
+		}
+
+		c, err := newClient(conf)
+		if err != nil {
+			l.Fatal().Err(err).Msg("unable to initialize client")
+		}
+		defer c.Close() //nolint:errcheck
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tSHARED\tOWNER\tHOLDERS\tFENCING\tCREATED\tVALID UNTIL\tEXPIRED") //nolint:errcheck
+
+		var page string
+		for {
+			locks, next, err := c.ListLocks(context.Background(), prefix, 0, page, expired)
+			if err != nil {
+				l.Fatal().Err(err).Msg("unable to list locks")
+			}
+			for _, li := range locks {
+				lk := li.Lock
+				fmt.Fprintf(w, "%s\t%t\t%s\t%d\t%d\t%s\t%s\t%t\n", //nolint:errcheck
+					li.Key, lk.Shared, lk.Owner, len(lk.Holders), lk.FencingToken,
+					formatTimestamp(lk.CreatedAt), formatTimestamp(lk.ValidUntil), li.Expired)
+			}
+			if next == "" {
+				break
+			}
+			page = next
+		}
+		w.Flush() //nolint:errcheck
+	},
+}
+
+var lockGetCmd = &cobra.Command{
+	Use:   "get <key>",
+	Short: "Show the holders of a lock",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, l := mustConf()
+
+		expired, _ := cmd.Flags().GetBool("expired")
+
+		c, err := newClient(conf)
+		if err != nil {
+			l.Fatal().Err(err).Msg("unable to initialize client")
+		}
+		defer c.Close() //nolint:errcheck
+
+		li, err := c.GetLock(context.Background(), args[0], expired)
+		if err != nil {
+			l.Fatal().Err(err).Msg("unable to get lock")
+		}
+
+		fmt.Printf("Key: %s\nShared: %t\nExpired: %t\n\n", li.Key, li.Lock.Shared, li.Expired)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "OWNER\tFENCING\tCREATED\tVALID UNTIL\tHOST\tPID\tJOB\tREASON\tLABELS") //nolint:errcheck
+		for _, h := range li.Lock.Holders {
+			md := h.GetMetadata()
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", //nolint:errcheck
+				h.Owner, h.FencingToken, formatTimestamp(h.CreatedAt), formatTimestamp(h.ValidUntil),
+				orDash(md.GetHostname()), formatPid(md.GetPid()), orDash(md.GetJobId()), orDash(md.GetReason()),
+				formatLabels(md.GetLabels()))
+		}
+		w.Flush() //nolint:errcheck
+	},
+}
+
+var lockForceReleaseCmd = &cobra.Command{
+	Use:   "force-release <key>",
+	Short: "Release a lock whoever holds it",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, l := mustConf()
+
+		owner, _ := cmd.Flags().GetString("owner")
+		reason, _ := cmd.Flags().GetString("reason")
+
+		c, err := newClient(conf)
+		if err != nil {
+			l.Fatal().Err(err).Msg("unable to initialize client")
+		}
+		defer c.Close() //nolint:errcheck
+
+		released, err := c.ForceReleaseLock(context.Background(), args[0], owner, reason)
+		if err != nil {
+			l.Fatal().Err(err).Msg("unable to force lock release")
+		}
+
+		for _, h := range released {
+			l.Info().Str("lock", args[0]).Str("owner", h.Owner).Msg("lock released")
+		}
+	},
+}
+
+// orDash returns s, or a dash if s is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// formatPid returns the process ID, or a dash if it isn't known.
+func formatPid(pid int64) string {
+	if pid == 0 {
+		return "-"
+	}
+
+	return strconv.FormatInt(pid, 10)
+}
+
+// formatLabels returns the labels as comma separated key=value pairs sorted
+// by key, or a dash if there are none.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+
+	pairs := make([]string, 0, len(labels))
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+
+	return strings.Join(pairs, ",")
+}
@@ -13,6 +13,7 @@ func Setup(com *cobra.Command) {
 	addLoggerFlags(com)
 	addServerFlags(com)
 	addDatabaseFlags(com)
+	addClientFlags(com)
 
 	// Bind flags
 	if err := viper.BindPFlags(com.PersistentFlags()); err != nil {
@@ -23,9 +24,36 @@ func Setup(com *cobra.Command) {
 	com.AddCommand(versionCmd)
 
 	// Setup cert command
+	addCertIssueFlags(certGenServerCmd)
+	addCertIssueFlags(certGenClientCmd)
+	addCertCheckFlags(certCheckCmd)
+	certGenCmd.AddCommand(certGenServerCmd)
+	certGenCmd.AddCommand(certGenClientCmd)
 	certCmd.AddCommand(certCheckCmd)
 	certCmd.AddCommand(certGenCmd)
 
 	// Add cert command
 	com.AddCommand(certCmd)
+
+	// Setup token command
+	addTokenCreateFlags(tokenCreateCmd)
+	tokenCmd.AddCommand(tokenGenCmd)
+	tokenCmd.AddCommand(tokenHashCmd)
+	tokenCmd.AddCommand(tokenCreateCmd)
+	tokenCmd.AddCommand(tokenRevokeCmd)
+	tokenCmd.AddCommand(tokenListCmd)
+
+	// Add token command
+	com.AddCommand(tokenCmd)
+
+	// Setup lock command
+	addLockInspectFlags(lockListCmd)
+	addLockInspectFlags(lockGetCmd)
+	lockCmd.AddCommand(lockListCmd)
+	lockCmd.AddCommand(lockGetCmd)
+	addLockForceReleaseFlags(lockForceReleaseCmd)
+	lockCmd.AddCommand(lockForceReleaseCmd)
+
+	// Add lock command
+	com.AddCommand(lockCmd)
 }
@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	capybara "github.com/depado/capybara/client"
+)
+
+// GenerateToken returns a new random secret token.
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("read random: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken returns the sha256 hash of the given secret token. This is the
+// only form in which tokens are stored.
+func HashToken(secret string) []byte {
+	h := sha256.Sum256([]byte(secret))
+	return h[:]
+}
+
+// newClient creates a capybara client using the client configuration.
+// The client connects with TLS unless client.insecure is set, in which case the
+// certificate paths are ignored.
+func newClient(conf *Conf) (*capybara.Client, error) {
+	if conf.Client.Insecure {
+		return capybara.NewClient(conf.Client.Addr, capybara.ClientOpts{Token: conf.Client.Token})
+	}
+
+	if conf.Client.CAPath == "" {
+		return nil, fmt.Errorf("no CA certificate: set --client.ca_path, or --client.insecure if the server's TLS is disabled")
+	}
+
+	if _, err := os.Stat(conf.Client.CAPath); err != nil {
+		return nil, fmt.Errorf("CA certificate: %w: set --client.ca_path to the server's CA, or --client.insecure if the server's TLS is disabled", err)
+	}
+
+	return capybara.NewClient(conf.Client.Addr, capybara.ClientOpts{
+		Token:          conf.Client.Token,
+		CertPath:       conf.Client.CAPath,
+		ClientCertPath: conf.Client.CertPath,
+		ClientKeyPath:  conf.Client.KeyPath,
+	})
+}
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage the tokens used to authenticate against capybara",
+	Run: func(cmd *cobra.Command, args []string) {
+	},
+}
+
+var tokenGenCmd = &cobra.Command{
+	Use:   "gen",
+	Short: "Generate a new token and its hash to declare in the configuration",
+	Run: func(cmd *cobra.Command, args []string) {
+		_, l := mustConf()
+
+		secret, err := GenerateToken()
+		if err != nil {
+			l.Fatal().Err(err).Msg("unable to generate token")
+		}
+
+		fmt.Printf("Token: %s\nHash: %s\n", secret, hex.EncodeToString(HashToken(secret)))
+	},
+}
+
+var tokenHashCmd = &cobra.Command{
+	Use:   "hash",
+	Short: "Print the hash of a token read from stdin, to declare in the configuration",
+	Run: func(cmd *cobra.Command, args []string) {
+		_, l := mustConf()
+
+		// The token is read from stdin so it doesn't end up in the shell history
+		raw, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			l.Fatal().Err(err).Msg("unable to read token")
+		}
+
+		secret := strings.TrimSpace(string(raw))
+		if secret == "" {
+			l.Fatal().Msg("empty token")
+		}
+
+		fmt.Println(hex.EncodeToString(HashToken(secret)))
+	},
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create a new token on a running server",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, l := mustConf()
+
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		admin, _ := cmd.Flags().GetBool("admin")
+		scopes, _ := cmd.Flags().GetStringArray("scope")
+
+		c, err := newClient(conf)
+		if err != nil {
+			l.Fatal().Err(err).Msg("unable to initialize client")
+		}
+		defer c.Close() //nolint:errcheck
+
+		secret, _, err := c.CreateToken(args[0], ttl, admin, scopes...)
+		if err != nil {
+			l.Fatal().Err(err).Msg("unable to create token")
+		}
+
+		fmt.Println(secret)
+	},
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke <name>",
+	Short: "Revoke a token on a running server",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, l := mustConf()
+
+		c, err := newClient(conf)
+		if err != nil {
+			l.Fatal().Err(err).Msg("unable to initialize client")
+		}
+		defer c.Close() //nolint:errcheck
+
+		if err := c.RevokeToken(args[0]); err != nil {
+			l.Fatal().Err(err).Msg("unable to revoke token")
+		}
+
+		l.Info().Str("name", args[0]).Msg("token revoked")
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the tokens of a running server",
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, l := mustConf()
+
+		c, err := newClient(conf)
+		if err != nil {
+			l.Fatal().Err(err).Msg("unable to initialize client")
+		}
+		defer c.Close() //nolint:errcheck
+
+		tokens, err := c.ListTokens()
+		if err != nil {
+			l.Fatal().Err(err).Msg("unable to list tokens")
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tADMIN\tSCOPES\tCREATED\tEXPIRES\tREVOKED") //nolint:errcheck
+		for _, t := range tokens {
+			fmt.Fprintf(w, "%s\t%t\t%s\t%s\t%s\t%s\n", //nolint:errcheck
+				t.Name, t.Admin, strings.Join(t.Scopes, ","),
+				formatTimestamp(t.CreatedAt), formatTimestamp(t.ExpiresAt), formatTimestamp(t.RevokedAt))
+		}
+		w.Flush() //nolint:errcheck
+	},
+}
+
+// formatTimestamp formats an optional protobuf timestamp for display.
+func formatTimestamp(t *timestamppb.Timestamp) string {
+	if t == nil {
+		return "-"
+	}
+
+	return t.AsTime().Format(time.RFC3339)
+}
@@ -0,0 +1,161 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/depado/capybara/pb"
+)
+
+// errClaimRefused rolls back a batch claim when one of its locks can't be
+// acquired.
+var errClaimRefused = errors.New("batch claim refused")
+
+// sortKeys returns the keys sorted and without duplicates.
+func sortKeys(keys []string) []string {
+	return slices.Compact(slices.Sorted(slices.Values(keys)))
+}
+
+// ClaimLocks claims several locks at once, each of them the way ClaimLock
+// does. The claim is atomic: either all the locks are held by owner once it
+// returns, or none of them was modified. The keys are claimed in order and
+// without duplicates, so that concurrent batch claims always contend on the
+// same key first.
+//
+// The returned boolean is true if all the locks are held by owner. The
+// returned locks are sorted by key, they are the claimed locks if the claim
+// succeeded, or the locks as they were found otherwise.
+func (cdb *CapybaraDB) ClaimLocks(keys []string, owner string, opts ClaimOptions) ([]*pb.LockInfo, bool, error) {
+	start := time.Now()
+
+	keys = sortKeys(keys)
+
+	cdb.locksm.Lock()
+	defer cdb.locksm.Unlock()
+
+	var events []*pb.LockEvent
+	var infos []*pb.LockInfo
+
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		events, infos = nil, nil
+
+		b := t.Bucket([]byte(LocksBucket))
+		if b == nil {
+			return ErrLocksBucketNotFound
+		}
+
+		for _, k := range keys {
+			lock, acquired, evs, err := cdb.claim(b, k, owner, opts, false)
+			if err != nil {
+				return fmt.Errorf("lock %s: %w", k, err)
+			}
+
+			if !acquired && !heldBy(lock, owner, opts.Shared) {
+				cdb.log.Debug().Str("lock", k).Str("claimer", owner).Msg("batch claim refused")
+				return errClaimRefused
+			}
+
+			events = append(events, evs...)
+			infos = append(infos, &pb.LockInfo{Key: k, Lock: lock})
+		}
+
+		return nil
+	})
+
+	cdb.log.Debug().Str("took", time.Since(start).String()).Msg("batch lock claim completed")
+
+	switch {
+	case errors.Is(err, errClaimRefused):
+		infos, err = cdb.currentLocks(keys)
+		return infos, false, err
+	case err != nil:
+		return nil, false, err
+	}
+
+	cdb.publish(events...)
+
+	return infos, true, nil
+}
+
+// currentLocks returns the locks stored at the given keys, without their
+// expired holders.
+func (cdb *CapybaraDB) currentLocks(keys []string) ([]*pb.LockInfo, error) {
+	var infos []*pb.LockInfo
+
+	err := cdb.db.View(func(t *bolt.Tx) error {
+		infos = nil
+
+		b := t.Bucket([]byte(LocksBucket))
+		if b == nil {
+			return ErrLocksBucketNotFound
+		}
+
+		now := time.Now()
+		for _, k := range keys {
+			lock, err := loadLock(b, k)
+			if err != nil {
+				return fmt.Errorf("lock %s: %w", k, err)
+			}
+
+			expireHolders(&lock.Holders, now)
+			summarize(lock)
+			infos = append(infos, &pb.LockInfo{Key: k, Lock: lock})
+		}
+
+		return nil
+	})
+
+	return infos, err
+}
+
+// ReleaseLocks releases owner's hold on several locks at once, each of them
+// the way ReleaseLock does. Every lock held by owner is released even if
+// others aren't: the returned error then joins an ErrLockNotFound or
+// ErrNotOwner error for each of them.
+func (cdb *CapybaraDB) ReleaseLocks(keys []string, owner string) error {
+	start := time.Now()
+
+	keys = sortKeys(keys)
+
+	cdb.locksm.Lock()
+	defer cdb.locksm.Unlock()
+
+	var events []*pb.LockEvent
+	var rerrs []error
+
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		events, rerrs = nil, nil
+
+		b := t.Bucket([]byte(LocksBucket))
+		if b == nil {
+			return ErrLocksBucketNotFound
+		}
+
+		for _, k := range keys {
+			evs, res, err := release(b, k, owner)
+			if err != nil {
+				return fmt.Errorf("lock %s: %w", k, err)
+			}
+			if res != released {
+				rerrs = append(rerrs, fmt.Errorf("lock %s: %w", k, res.err()))
+			}
+			events = append(events, evs...)
+		}
+
+		return nil
+	})
+
+	cdb.log.Debug().Str("took", time.Since(start).String()).Msg("batch lock release completed")
+
+	if err != nil {
+		return err
+	}
+
+	cdb.publish(events...)
+
+	return errors.Join(rerrs...)
+}
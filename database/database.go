@@ -3,6 +3,7 @@ package database
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
@@ -15,20 +16,76 @@ import (
 const (
 	// LocksBucket is the default bucket used to store the locks.
 	LocksBucket = "_locks"
+	// TokensBucket is the bucket used to store the authentication tokens.
+	TokensBucket = "_tokens"
+	// SemaphoresBucket is the bucket used to store the semaphores.
+	SemaphoresBucket = "_semaphores"
+	// SessionsBucket is the bucket used to store the sessions.
+	SessionsBucket = "_sessions"
+	// KVMetaBucket is the bucket used to index the expiration of kv entries.
+	KVMetaBucket = "_kv_meta"
+	// MetaBucket is the bucket used to store the schema version of the
+	// database and the revision counter of kv entries.
+	MetaBucket = "_meta"
 )
 
+// internalBuckets lists the buckets used internally by capybara, which can't
+// be accessed through the kv operations.
+var internalBuckets = []string{LocksBucket, TokensBucket, SemaphoresBucket, SessionsBucket, KVMetaBucket, MetaBucket}
+
 // ErrLocksBucketNotFound is the error returned when the bucket isn't found.
 var ErrLocksBucketNotFound = errors.New("locks bucket not found")
 
+// ErrTokensBucketNotFound is the error returned when the tokens bucket isn't
+// found.
+var ErrTokensBucketNotFound = errors.New("tokens bucket not found")
+
+// ErrSemaphoresBucketNotFound is the error returned when the semaphores bucket
+// isn't found.
+var ErrSemaphoresBucketNotFound = errors.New("semaphores bucket not found")
+
+// ErrSessionsBucketNotFound is the error returned when the sessions bucket
+// isn't found.
+var ErrSessionsBucketNotFound = errors.New("sessions bucket not found")
+
+// ErrKVMetaBucketNotFound is the error returned when the kv meta bucket isn't
+// found.
+var ErrKVMetaBucketNotFound = errors.New("kv meta bucket not found")
+
+// ErrMetaBucketNotFound is the error returned when the meta bucket isn't
+// found.
+var ErrMetaBucketNotFound = errors.New("meta bucket not found")
+
+// IsInternalBucket returns whether the given top-level bucket is reserved for
+// capybara's internal use.
+func IsInternalBucket(bucket string) bool {
+	return slices.Contains(internalBuckets, bucket)
+}
+
 // CapybaraDB is the struct representing a capybara database.
 type CapybaraDB struct {
 	db     *bolt.DB
 	log    zerolog.Logger
 	locksm sync.RWMutex
+
+	defaultLockTTL time.Duration
+
+	waitm   sync.Mutex
+	waiters map[string][]*waiter
+
+	watchm   sync.Mutex
+	watchers map[*watcher]struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	sweepwg  sync.WaitGroup
 }
 
-// Close will close the database.
+// Close will stop the background tasks and close the database.
 func (c *CapybaraDB) Close() error {
+	c.stopOnce.Do(func() { close(c.stop) })
+	c.sweepwg.Wait()
+
 	c.log.Debug().Msg("closing database")
 	return c.db.Close()
 }
@@ -46,17 +103,57 @@ func NewCapybaraDB(conf *cmd.Conf, l zerolog.Logger) (*CapybaraDB, error) {
 
 	log.Debug().Msg("initialized")
 
+	// The internal buckets are created and the data migrated at once, a
+	// database without schema version predates them
+	var migrated int
+	err = db.Update(func(t *bolt.Tx) error {
+		if storedSchemaVersion(t) == 0 {
+			if err := checkReservedBuckets(t); err != nil {
+				return err
+			}
+		}
+		for _, b := range internalBuckets {
+			if _, err := t.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return fmt.Errorf("create bucket %s: %w", b, err)
+			}
+		}
+		migrated, err = migrate(t)
+		return err
+	})
+	if err != nil {
+		db.Close() //nolint:errcheck
+		return nil, fmt.Errorf("unable to initialize database: %w", err)
+	}
+
+	if migrated > 0 {
+		log.Info().Int("entries", migrated).Int("schema_version", schemaVersion).Msg("migrated database")
+	}
+
+	var imported, revoked int
 	err = db.Update(func(t *bolt.Tx) error {
-		_, err := t.CreateBucketIfNotExists([]byte(LocksBucket))
+		imported, revoked, err = importTokens(t, conf.Auth.Tokens)
 		return err
 	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to initialize buckets: %w", err)
+		return nil, fmt.Errorf("unable to import tokens: %w", err)
 	}
 
+	log.Debug().Int("imported", imported).Int("revoked", revoked).Msg("imported tokens from configuration")
+
 	cdb := &CapybaraDB{
-		db:  db,
-		log: log,
+		db:             db,
+		log:            log,
+		defaultLockTTL: conf.Database.DefaultLockTTL,
+		waiters:        make(map[string][]*waiter),
+		watchers:       make(map[*watcher]struct{}),
+		stop:           make(chan struct{}),
+	}
+
+	if conf.Database.LockSweepInterval > 0 {
+		cdb.sweepwg.Add(1)
+		go cdb.sweeper(conf.Database.LockSweepInterval)
+	} else {
+		log.Warn().Msg("sweeper is disabled, expired locks are only deleted when claimed or released, expired sessions and keys are kept")
 	}
 
 	return cdb, nil
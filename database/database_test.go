@@ -0,0 +1,38 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/depado/capybara/cmd"
+)
+
+// newTestDB opens a database in a temporary directory, without a sweeper.
+// It is closed when the test ends.
+func newTestDB(t *testing.T) *CapybaraDB {
+	t.Helper()
+
+	return openTestDB(t, filepath.Join(t.TempDir(), "capybara.db"))
+}
+
+// openTestDB opens the database stored at path, without a sweeper. It is
+// closed when the test ends.
+func openTestDB(t *testing.T, path string) *CapybaraDB {
+	t.Helper()
+
+	conf := &cmd.Conf{Database: cmd.DatabaseConf{Path: path, DefaultLockTTL: time.Minute}}
+	cdb, err := NewCapybaraDB(conf, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := cdb.Close(); err != nil {
+			t.Errorf("close database: %v", err)
+		}
+	})
+
+	return cdb
+}
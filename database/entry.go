@@ -0,0 +1,80 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/depado/capybara/pb"
+)
+
+// loadEntry reads the kv entry stored at key in bucket b, or returns nil if
+// there is none.
+func loadEntry(b *bolt.Bucket, key string) (*pb.Entry, error) {
+	raw := b.Get([]byte(key))
+	if raw == nil {
+		return nil, nil
+	}
+
+	e := &pb.Entry{}
+	if err := proto.Unmarshal(raw, e); err != nil {
+		return nil, fmt.Errorf("proto unmarshal: %w", err)
+	}
+
+	return e, nil
+}
+
+// saveEntry stores the kv entry at key in bucket b.
+func saveEntry(b *bolt.Bucket, key string, e *pb.Entry) error {
+	raw, err := proto.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("proto marshal: %w", err)
+	}
+
+	return b.Put([]byte(key), raw)
+}
+
+// currentEntry returns the kv entry stored at key in bucket b, or nil if
+// there is none, if it expired or if the session it is attached to ended.
+func currentEntry(b *bolt.Bucket, key string) (*pb.Entry, error) {
+	e, err := loadEntry(b, key)
+	if err != nil || e == nil {
+		return nil, err
+	}
+
+	if e.ValidUntil != nil && !e.ValidUntil.AsTime().After(time.Now()) {
+		return nil, nil
+	}
+
+	// The entry is only deleted once the sweeper ends the expired session
+	if e.Session != "" {
+		_, _, err := activeSession(b.Tx(), e.Session)
+		switch {
+		case errors.Is(err, ErrSessionNotFound), errors.Is(err, ErrSessionExpired):
+			return nil, nil
+		case err != nil:
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// nextRevision returns a new revision, greater than all the revisions
+// previously given to kv entries.
+func nextRevision(t *bolt.Tx) (uint64, error) {
+	b := t.Bucket([]byte(MetaBucket))
+	if b == nil {
+		return 0, ErrMetaBucketNotFound
+	}
+
+	rev, err := b.NextSequence()
+	if err != nil {
+		return 0, fmt.Errorf("next revision: %w", err)
+	}
+
+	return rev, nil
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/depado/capybara/pb"
+)
+
+// lockInfo creates the information returned on a lock, or nil if all its
+// holders expired and includeExpired is false. Unless includeExpired is true,
+// the expired holders are left out.
+func lockInfo(key string, lock *pb.Lock, now time.Time, includeExpired bool) *pb.LockInfo {
+	expired := !slices.ContainsFunc(lock.Holders, func(h *pb.Holder) bool {
+		return h.ValidUntil.AsTime().After(now)
+	})
+
+	if !includeExpired {
+		if expired {
+			return nil
+		}
+		expireHolders(&lock.Holders, now)
+		summarize(lock)
+	}
+
+	return &pb.LockInfo{Key: key, Lock: lock, Expired: expired}
+}
+
+// GetLock returns the lock stored at key without claiming it. ErrLockNotFound
+// is returned if there is no such lock, or if all its holders expired and
+// includeExpired is false.
+func (cdb *CapybaraDB) GetLock(key string, includeExpired bool) (*pb.LockInfo, error) {
+	var info *pb.LockInfo
+
+	err := cdb.db.View(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(LocksBucket))
+		if b == nil {
+			return ErrLocksBucketNotFound
+		}
+
+		lock, err := loadLock(b, key)
+		if err != nil {
+			return err
+		}
+
+		if len(lock.Holders) > 0 {
+			info = lockInfo(key, lock, time.Now(), includeExpired)
+		}
+		if info == nil {
+			return ErrLockNotFound
+		}
+		return nil
+	})
+
+	return info, err
+}
+
+// ListLocks returns at most limit locks whose key starts with prefix, in key
+// order, starting after the given key if any. Locks whose holders all expired
+// are left out unless includeExpired is true. The returned key is the one to
+// start after to get the next page, it is empty when there are no more locks.
+func (cdb *CapybaraDB) ListLocks(prefix, after string, limit int, includeExpired bool) ([]*pb.LockInfo, string, error) {
+	var infos []*pb.LockInfo
+	var next string
+
+	err := cdb.db.View(func(t *bolt.Tx) error {
+		infos, next = nil, ""
+
+		b := t.Bucket([]byte(LocksBucket))
+		if b == nil {
+			return ErrLocksBucketNotFound
+		}
+
+		start := []byte(prefix)
+		if after > prefix {
+			start = []byte(after)
+		}
+
+		now := time.Now()
+		c := b.Cursor()
+		for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			if string(k) == after {
+				continue
+			}
+
+			lock, err := loadLock(b, string(k))
+			if err != nil {
+				return fmt.Errorf("lock %s: %w", k, err)
+			}
+
+			info := lockInfo(string(k), lock, now, includeExpired)
+			if info == nil {
+				continue
+			}
+
+			// There is at least one more lock after this page
+			if len(infos) == limit {
+				next = infos[len(infos)-1].Key
+				return nil
+			}
+			infos = append(infos, info)
+		}
+		return nil
+	})
+
+	return infos, next, err
+}
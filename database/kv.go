@@ -1,6 +1,7 @@
 package database
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"strings"
@@ -8,6 +9,9 @@ import (
 
 	bolt "go.etcd.io/bbolt"
 	bolterrors "go.etcd.io/bbolt/errors"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/depado/capybara/pb"
 )
 
 var (
@@ -20,6 +24,15 @@ var (
 	// that is actually a bucket or a bucket that is actually a key. Basically
 	// that means the bucket path + key is invalid.
 	ErrIncompatibleValue = errors.New("incompatible value")
+	// ErrInternalBucket is returned when trying to access one of the buckets
+	// used internally by capybara.
+	ErrInternalBucket = errors.New("internal bucket")
+	// ErrKeyNotFound is returned when getting a key that doesn't exist or
+	// that expired.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrConditionFailed is returned when the condition of a conditional put
+	// or delete isn't met.
+	ErrConditionFailed = errors.New("condition failed")
 )
 
 // TraverseCreate will traverse the whole bucket tree defined in the buckets
@@ -59,27 +72,206 @@ func Traverse(t *bolt.Tx, buckets []string) (*bolt.Bucket, error) {
 	return b, nil
 }
 
+// updateEach calls collect on every key of the bucket, then calls apply on
+// each item collected, in order, and returns the number of applied items.
+// Keys can't be modified while iterating with ForEach, which is why the
+// changes are only made once the iteration is done.
+func updateEach[T any](b *bolt.Bucket, collect func(k, v []byte) (T, bool, error), apply func(k string, item T) error) (int, error) {
+	var keys []string
+	var items []T
+
+	err := b.ForEach(func(k, v []byte) error {
+		item, ok, err := collect(k, v)
+		if err != nil || !ok {
+			return err
+		}
+		keys = append(keys, string(k))
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, k := range keys {
+		if err := apply(k, items[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(keys), nil
+}
+
+// PutOptions are the options of a put operation.
+//
+// Fence: If set, the value is only written if the fence's lock is still held
+// with the fence's token, ErrFenced is returned otherwise.
+// Session: If set, the key is deleted when the session ends, unless it was
+// written again without the session or with another one in the meantime.
+// ErrSessionNotFound or ErrSessionExpired is returned if the session can't be
+// used, and ErrNotOwner if it isn't owned by Owner.
+// Owner: The owner of the session, if any.
+// Token: The name of the token the session was created with, any token
+// matching if empty.
+// TTL: If set, the key expires after the given duration and is deleted in the
+// background. Otherwise the key never expires, even if it was written with a
+// TTL before.
+// IfAbsent, IfValue, IfRevision: If set, the value is only written if the
+// key doesn't exist, if its current value is IfValue or if its current
+// revision is IfRevision, ErrConditionFailed is returned otherwise. Expired
+// keys don't exist.
+// Writer: The identity of the writer, stored along with the value.
+type PutOptions struct {
+	Fence      *Fence
+	Session    string
+	Owner      string
+	Token      string
+	TTL        *time.Duration
+	IfAbsent   bool
+	IfValue    []byte
+	IfRevision *uint64
+	Writer     string
+}
+
+// check returns ErrConditionFailed unless the current entry of the key, nil
+// if it doesn't exist, meets the put's conditions.
+func (opts PutOptions) check(e *pb.Entry) error {
+	switch {
+	case opts.IfAbsent && e != nil:
+		return fmt.Errorf("key exists: %w", ErrConditionFailed)
+	case opts.IfValue != nil && (e == nil || !bytes.Equal(e.Value, opts.IfValue)):
+		return fmt.Errorf("value doesn't match: %w", ErrConditionFailed)
+	case opts.IfRevision != nil && (e == nil || e.ModRevision != *opts.IfRevision):
+		return fmt.Errorf("revision doesn't match: %w", ErrConditionFailed)
+	}
+
+	return nil
+}
+
+// DeleteOptions are the options of a delete operation.
+//
+// Fence: If set, the key is only deleted if the fence's lock is still held
+// with the fence's token, ErrFenced is returned otherwise.
+// IfRevision: If set, the key is only deleted if its current revision is
+// IfRevision, ErrConditionFailed is returned otherwise.
+type DeleteOptions struct {
+	Fence      *Fence
+	IfRevision *uint64
+}
+
+// checkBuckets returns an error if no bucket is given or if the path starts
+// with an internal bucket.
+func checkBuckets(buckets []string) error {
+	if len(buckets) == 0 {
+		return ErrNoBucket
+	}
+
+	if IsInternalBucket(buckets[0]) {
+		return ErrInternalBucket
+	}
+
+	return nil
+}
+
 // Put puts a value at the given key in the given bucket. The buckets will be
 // created on the fly if need be. An error will be returned if no bucket
 // is provided or if the path is invalid.
 func (cdb *CapybaraDB) Put(buckets []string, key string, value []byte) error {
+	_, err := cdb.PutWithOptions(buckets, key, value, PutOptions{})
+	return err
+}
+
+// PutWithOptions is like Put but accepts options, and returns the new
+// revision of the key.
+func (cdb *CapybaraDB) PutWithOptions(buckets []string, key string, value []byte, opts PutOptions) (uint64, error) {
 	start := time.Now()
 	defer func() {
 		cdb.log.Debug().Str("took", time.Since(start).String()).Str("key", key).Str("action", "put").Send()
 	}()
 
-	if len(buckets) == 0 {
-		return ErrNoBucket
+	if err := checkBuckets(buckets); err != nil {
+		return 0, err
 	}
 
+	var rev uint64
+
 	err := cdb.db.Update(func(t *bolt.Tx) error {
-		b, err := TraverseCreate(t, buckets)
+		var err error
+		rev, err = putKey(t, buckets, key, value, opts)
+		return err
+	})
+
+	return rev, err
+}
+
+// putKey writes the value at the given key within the transaction, and
+// returns its new revision.
+func putKey(t *bolt.Tx, buckets []string, key string, value []byte, opts PutOptions) (uint64, error) {
+	if opts.Fence != nil {
+		if err := checkFence(t, opts.Fence); err != nil {
+			return 0, err
+		}
+	}
+	b, err := TraverseCreate(t, buckets)
+	if err != nil {
+		return 0, incompatible(err)
+	}
+	mb, err := metaBucket(t)
+	if err != nil {
+		return 0, err
+	}
+	current, err := currentEntry(b, key)
+	if err != nil {
+		return 0, err
+	}
+	if err := opts.check(current); err != nil {
+		return 0, err
+	}
+	rev, err := nextRevision(t)
+	if err != nil {
+		return 0, err
+	}
+	now := timestamppb.Now()
+	e := &pb.Entry{
+		Value:          value,
+		CreateRevision: rev,
+		ModRevision:    rev,
+		Version:        1,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Writer:         opts.Writer,
+		Session:        opts.Session,
+	}
+	if current != nil {
+		e.CreateRevision, e.CreatedAt, e.Version = current.CreateRevision, current.CreatedAt, current.Version+1
+	}
+	if opts.TTL != nil {
+		e.ValidUntil = timestamppb.New(now.AsTime().Add(*opts.TTL))
+	}
+	if err := saveEntry(b, key, e); err != nil {
+		return 0, incompatible(err)
+	}
+	if err := setKeyExpiry(mb, buckets, key, e.ValidUntil); err != nil {
+		return 0, err
+	}
+	if opts.Session != "" {
+		sb, sess, err := activeSession(t, opts.Session)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		return b.Put([]byte(key), value)
-	})
+		if err := checkSessionOwner(sess, opts.Owner, opts.Token); err != nil {
+			return 0, err
+		}
+		if err := attachKey(sb, sess, buckets, key); err != nil {
+			return 0, err
+		}
+	}
+	return rev, nil
+}
 
+// incompatible replaces bbolt's incompatible value error with
+// ErrIncompatibleValue.
+func incompatible(err error) error {
 	if errors.Is(err, bolterrors.ErrIncompatibleValue) {
 		return ErrIncompatibleValue
 	}
@@ -104,24 +296,49 @@ func (cdb *CapybaraDB) PutPath(path, sep string, value []byte) error {
 // Delete will attempt to delete the provided key in the given bucket path.
 // An error is returned if the operation can't complete.
 func (cdb *CapybaraDB) Delete(buckets []string, key string) error {
+	return cdb.DeleteWithOptions(buckets, key, DeleteOptions{})
+}
+
+// DeleteWithOptions is like Delete but accepts options.
+func (cdb *CapybaraDB) DeleteWithOptions(buckets []string, key string, opts DeleteOptions) error {
 	start := time.Now()
 	defer func() {
 		cdb.log.Debug().Str("took", time.Since(start).String()).Str("key", key).Str("action", "delete").Send()
 	}()
 
-	if len(buckets) == 0 {
-		return ErrNoBucket
+	if err := checkBuckets(buckets); err != nil {
+		return err
 	}
 
-	err := cdb.db.Update(func(t *bolt.Tx) error {
-		b, err := Traverse(t, buckets)
+	return cdb.db.Update(func(t *bolt.Tx) error {
+		return deleteKey(t, buckets, key, opts)
+	})
+}
+
+// deleteKey deletes the given key within the transaction.
+func deleteKey(t *bolt.Tx, buckets []string, key string, opts DeleteOptions) error {
+	if opts.Fence != nil {
+		if err := checkFence(t, opts.Fence); err != nil {
+			return err
+		}
+	}
+	b, err := Traverse(t, buckets)
+	if err != nil {
+		return err
+	}
+	if opts.IfRevision != nil {
+		current, err := currentEntry(b, key)
 		if err != nil {
 			return err
 		}
-		return b.Delete([]byte(key))
-	})
-
-	return err
+		if current == nil || current.ModRevision != *opts.IfRevision {
+			return fmt.Errorf("revision doesn't match: %w", ErrConditionFailed)
+		}
+	}
+	if err := b.Delete([]byte(key)); err != nil {
+		return incompatible(err)
+	}
+	return deleteKeyMeta(t, buckets, key)
 }
 
 // DeletePath will delete a key given a full path to the key and a separator.
@@ -136,37 +353,61 @@ func (cdb *CapybaraDB) DeletePath(path, sep string) error {
 	return cdb.Delete(buckets, key)
 }
 
-// Get returns the raw value of they key stored in the given bucket path.
+// Get returns the raw value of they key stored in the given bucket path, or
+// nil if there is no such key or if it expired.
 func (cdb *CapybaraDB) Get(buckets []string, key string) ([]byte, error) {
+	e, err := cdb.GetEntry(buckets, key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Value, nil
+}
+
+// GetEntry is like Get but returns the whole entry stored at the key, along
+// with its revisions and the identity of its last writer.
+func (cdb *CapybaraDB) GetEntry(buckets []string, key string) (*pb.Entry, error) {
 	start := time.Now()
 	defer func() {
 		cdb.log.Debug().Str("took", time.Since(start).String()).Str("key", key).Str("action", "get").Send()
 	}()
 
-	if len(buckets) == 0 {
-		return nil, ErrNoBucket
+	if err := checkBuckets(buckets); err != nil {
+		return nil, err
 	}
 
-	var out []byte
+	var e *pb.Entry
 
 	err := cdb.db.View(func(t *bolt.Tx) error {
-		b, err := Traverse(t, buckets)
-		if err != nil {
-			return err
-		}
-		if b.Bucket([]byte(key)) != nil {
-			return fmt.Errorf("key '%s' is a bucket: %w", key, ErrIncompatibleValue)
-		}
-		v := b.Get([]byte(key))
-		if v == nil {
-			return nil
-		}
-		out = make([]byte, len(v))
-		copy(out, v)
-		return nil
+		var err error
+		e, err = getKey(t, buckets, key)
+		return err
 	})
 
-	return out, err
+	return e, err
+}
+
+// getKey returns the entry stored at the given key within the transaction.
+// The entry is unmarshaled into a copy, it can be used after the transaction.
+func getKey(t *bolt.Tx, buckets []string, key string) (*pb.Entry, error) {
+	b, err := Traverse(t, buckets)
+	if err != nil {
+		return nil, err
+	}
+	if b.Bucket([]byte(key)) != nil {
+		return nil, fmt.Errorf("key '%s' is a bucket: %w", key, ErrIncompatibleValue)
+	}
+	e, err := currentEntry(b, key)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, ErrKeyNotFound
+	}
+	return e, nil
 }
 
 // GetPath will return the path.
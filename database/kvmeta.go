@@ -0,0 +1,59 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/depado/capybara/pb"
+)
+
+// metaKey returns the key of a kv entry in the kv meta bucket.
+func metaKey(buckets []string, key string) []byte {
+	return []byte(strings.Join(slices.Concat(buckets, []string{key}), "\x00"))
+}
+
+// metaBucket returns the kv meta bucket.
+func metaBucket(t *bolt.Tx) (*bolt.Bucket, error) {
+	mb := t.Bucket([]byte(KVMetaBucket))
+	if mb == nil {
+		return nil, ErrKVMetaBucketNotFound
+	}
+
+	return mb, nil
+}
+
+// setKeyExpiry indexes the expiration of the kv entry, or removes it from the
+// index if validUntil is nil because the entry never expires.
+func setKeyExpiry(mb *bolt.Bucket, buckets []string, key string, validUntil *timestamppb.Timestamp) error {
+	if validUntil == nil {
+		return mb.Delete(metaKey(buckets, key))
+	}
+
+	raw, err := proto.Marshal(&pb.KeyMeta{Buckets: buckets, Key: key, ValidUntil: validUntil})
+	if err != nil {
+		return fmt.Errorf("proto marshal: %w", err)
+	}
+
+	return mb.Put(metaKey(buckets, key), raw)
+}
+
+// deleteKeyMeta removes a deleted kv entry from the index.
+func deleteKeyMeta(t *bolt.Tx, buckets []string, key string) error {
+	mb, err := metaBucket(t)
+	if err != nil {
+		return err
+	}
+
+	return mb.Delete(metaKey(buckets, key))
+}
+
+// keyExpired returns whether the indexed kv entry expired at now.
+func keyExpired(meta *pb.KeyMeta, now time.Time) bool {
+	return meta != nil && meta.ValidUntil != nil && !meta.ValidUntil.AsTime().After(now)
+}
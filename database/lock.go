@@ -3,6 +3,7 @@ package database
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
@@ -18,118 +19,574 @@ var ErrNotOwner = errors.New("not the lock owner")
 // ErrLockNotFound is the error returned when a lock can't be found.
 var ErrLockNotFound = errors.New("lock not found")
 
+// ErrLockExpired is the error returned when refreshing a lock that already
+// expired.
+var ErrLockExpired = errors.New("lock expired")
+
+// ErrSessionBound is the error returned when refreshing a hold attached to a
+// session, which expires with the session instead.
+var ErrSessionBound = errors.New("lock held through a session")
+
+// ErrFenced is the error returned when a write is fenced by a lock that is no
+// longer held with the given fencing token.
+var ErrFenced = errors.New("fencing token is no longer current")
+
+// Fence makes a write conditional to the lock still being held with the given
+// fencing token.
+type Fence struct {
+	Lock  string
+	Token uint64
+}
+
+// checkFence returns ErrFenced unless the lock is held, by a holder that isn't
+// expired, with the fence's token.
+func checkFence(t *bolt.Tx, f *Fence) error {
+	b := t.Bucket([]byte(LocksBucket))
+	if b == nil {
+		return ErrLocksBucketNotFound
+	}
+
+	lock, err := loadLock(b, f.Lock)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, h := range lock.Holders {
+		if h.FencingToken == f.Token && h.ValidUntil.AsTime().After(now) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("lock %s isn't held with fencing token %d: %w", f.Lock, f.Token, ErrFenced)
+}
+
+// cloneLock returns a deep copy of the lock.
+func cloneLock(lock *pb.Lock) *pb.Lock {
+	return proto.Clone(lock).(*pb.Lock)
+}
+
+// loadLock reads the lock stored at key. An empty lock is returned if there
+// is none. Locks stored before shared locks existed have no holders, their
+// owner is converted to a holder.
+func loadLock(b *bolt.Bucket, key string) (*pb.Lock, error) {
+	lock := &pb.Lock{}
+
+	raw := b.Get([]byte(key))
+	if raw == nil {
+		return lock, nil
+	}
+
+	if err := proto.Unmarshal(raw, lock); err != nil {
+		return nil, fmt.Errorf("proto unmarshal: %w", err)
+	}
+
+	if len(lock.Holders) == 0 && lock.Owner != "" {
+		lock.Holders = []*pb.Holder{{
+			Owner:        lock.Owner,
+			CreatedAt:    lock.CreatedAt,
+			ValidUntil:   lock.ValidUntil,
+			FencingToken: lock.FencingToken,
+		}}
+	}
+
+	return lock, nil
+}
+
+// summarize updates the owner, creation, expiration and fencing token of the
+// lock from its holders.
+func summarize(lock *pb.Lock) {
+	lock.Owner, lock.CreatedAt, lock.ValidUntil, lock.FencingToken = "", nil, nil, 0
+
+	for i, h := range lock.Holders {
+		if i == 0 {
+			lock.Owner, lock.CreatedAt, lock.ValidUntil = h.Owner, h.CreatedAt, h.ValidUntil
+		}
+		if h.CreatedAt.AsTime().Before(lock.CreatedAt.AsTime()) {
+			lock.CreatedAt = h.CreatedAt
+		}
+		if h.ValidUntil.AsTime().After(lock.ValidUntil.AsTime()) {
+			lock.ValidUntil = h.ValidUntil
+		}
+		if h.FencingToken > lock.FencingToken {
+			lock.FencingToken = h.FencingToken
+		}
+	}
+}
+
+// saveLock stores the lock at key, or deletes it if it has no holder left.
+func saveLock(b *bolt.Bucket, key string, lock *pb.Lock) error {
+	summarize(lock)
+
+	if len(lock.Holders) == 0 {
+		if err := b.Delete([]byte(key)); err != nil {
+			return fmt.Errorf("delete lock: %w", err)
+		}
+		return nil
+	}
+
+	raw, err := proto.Marshal(lock)
+	if err != nil {
+		return fmt.Errorf("proto marshal: %w", err)
+	}
+
+	return b.Put([]byte(key), raw)
+}
+
+// expireHolders removes the holders that expired at now and returns them.
+// The callers save the remaining holders even when the operation fails, and
+// return that failure once the transaction is committed, since returning an
+// error from the transaction would rollback the deletion.
+func expireHolders(holders *[]*pb.Holder, now time.Time) []*pb.Holder {
+	var expired []*pb.Holder
+
+	*holders = slices.DeleteFunc(*holders, func(h *pb.Holder) bool {
+		if h.ValidUntil.AsTime().After(now) {
+			return false
+		}
+		expired = append(expired, h)
+		return true
+	})
+
+	return expired
+}
+
+// findHolder returns the holder of the lock with the given owner, if any.
+func findHolder(holders []*pb.Holder, owner string) *pb.Holder {
+	for _, h := range holders {
+		if h.Owner == owner {
+			return h
+		}
+	}
+
+	return nil
+}
+
+// heldBy returns whether owner holds the lock in the requested mode. An
+// exclusive lock satisfies a shared request.
+func heldBy(lock *pb.Lock, owner string, shared bool) bool {
+	return findHolder(lock.Holders, owner) != nil && (shared || !lock.Shared)
+}
+
+// nextExpiry returns the earliest expiration among the lock's holders.
+func nextExpiry(lock *pb.Lock) time.Time {
+	var next time.Time
+
+	for i, h := range lock.Holders {
+		if vu := h.ValidUntil.AsTime(); i == 0 || vu.Before(next) {
+			next = vu
+		}
+	}
+
+	return next
+}
+
+// ClaimOptions are the options of a lock claim.
+//
+// TTL: How long the lock is held, the configured default is used if nil.
+// Shared: Claim a shared lock instead of an exclusive one.
+// Metadata: Information attached to the claimer's hold. It replaces the
+// previous metadata when the lock is refreshed, unless nil.
+// Session: The session owned by the claimer to attach the hold to. The hold
+// then expires with the session, and TTL is ignored. Claiming a hold attached
+// to a session again without it detaches the hold from the session.
+// Token: The name of the token the session was created with, any token
+// matching if empty.
+type ClaimOptions struct {
+	TTL      *time.Duration
+	Shared   bool
+	Metadata *pb.HolderMetadata
+	Session  string
+	Token    string
+}
+
 // ClaimLock can be used to claim a lock. If the lock is already owned, it will
 // send back the lock's details. If the service creating this claim is the same
 // as the owner (defined by the owner parameter), the lock's expiration date
-// is delayed.
-func (cdb *CapybaraDB) ClaimLock(key, owner string, pttl *time.Duration) (*pb.Lock, bool, error) {
+// is delayed. When no ttl is given, the configured default is used.
+// Every acquisition is given a new fencing token, greater than all the
+// previously issued ones, which is kept when the lock is refreshed.
+//
+// A shared lock can be held by several owners at once, each with its own
+// expiration, while an exclusive lock has a single owner. A shared claim is
+// refused while a client waits for the exclusive lock, so that writers aren't
+// starved by a continuous flow of readers. The only holder of a shared lock
+// can upgrade it with an exclusive claim.
+//
+// A free lock isn't acquired while clients wait for it in WaitLock, so that
+// they are served first, in the order they arrived.
+func (cdb *CapybaraDB) ClaimLock(key, owner string, opts ClaimOptions) (*pb.Lock, bool, error) {
+	return cdb.claimLock(key, owner, opts, false)
+}
+
+// claimLock claims the lock. The queued parameter is set when the claim is
+// made by the first client in line in WaitLock, which is allowed to join a
+// shared lock even though exclusive waiters are queued behind it.
+func (cdb *CapybaraDB) claimLock(key, owner string, opts ClaimOptions, queued bool) (*pb.Lock, bool, error) {
 	start := time.Now()
 
 	var acquired bool
 
-	var ttl time.Duration
-	if pttl == nil {
-		ttl = 5 * time.Minute
-	} else {
+	cdb.locksm.Lock()
+	defer cdb.locksm.Unlock()
+
+	var events []*pb.LockEvent
+
+	var lock *pb.Lock
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(LocksBucket))
+		if b == nil {
+			return ErrLocksBucketNotFound
+		}
+
+		var err error
+		lock, acquired, events, err = cdb.claim(b, key, owner, opts, queued)
+		return err
+	})
+
+	cdb.log.Debug().Str("took", time.Since(start).String()).Msg("lock claim completed")
+
+	if err == nil {
+		cdb.publish(events...)
+	}
+
+	return lock, acquired, err
+}
+
+// claim claims the lock within the transaction of the locks bucket and
+// returns the lock, whether it was acquired and the events to publish once
+// the transaction is committed.
+func (cdb *CapybaraDB) claim(b *bolt.Bucket, key, owner string, opts ClaimOptions, queued bool) (*pb.Lock, bool, []*pb.LockEvent, error) {
+	var acquired bool
+	var events []*pb.LockEvent
+
+	ttl := cdb.defaultLockTTL
+	if opts.TTL != nil {
+		ttl = *opts.TTL
+	}
+	shared := opts.Shared
+
+	lock, err := loadLock(b, key)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	now := time.Now()
+	validUntil := now.Add(ttl)
+
+	var sb *bolt.Bucket
+	var sess *pb.Session
+	if opts.Session != "" {
+		if sb, sess, err = activeSession(b.Tx(), opts.Session); err != nil {
+			return nil, false, nil, err
+		}
+		if err := checkSessionOwner(sess, owner, opts.Token); err != nil {
+			return nil, false, nil, err
+		}
+		validUntil = sess.ValidUntil.AsTime()
+	}
+
+	for _, h := range expireHolders(&lock.Holders, now) {
+		cdb.log.Debug().Str("lock", key).Str("owner", h.Owner).Msg("lock holder expired")
+		events = append(events, newEvent(pb.LockEvent_EXPIRED, key, lock, h))
+	}
+
+	var held bool
+	h := findHolder(lock.Holders, owner)
+	switch {
+	case h != nil && !shared && lock.Shared && len(lock.Holders) == 1:
+		cdb.log.Debug().Str("lock", key).Str("owner", owner).Msg("only holder of the shared lock, upgrade")
+		seq, err := b.NextSequence()
+		if err != nil {
+			return nil, false, nil, fmt.Errorf("next fencing token: %w", err)
+		}
+		acquired, held = true, true
+		lock.Shared = false
+		h.FencingToken = seq
+		h.ValidUntil = timestamppb.New(validUntil)
+		if opts.Metadata != nil {
+			h.Metadata = opts.Metadata
+		}
+		h.Session = opts.Session
+		events = append(events, newEvent(pb.LockEvent_ACQUIRED, key, lock, h))
+	case h != nil && !shared && lock.Shared:
+		cdb.log.Debug().Str("lock", key).Str("claimer", owner).Msg("shared lock has other holders")
+	case h != nil:
+		cdb.log.Debug().Str("lock", key).Str("owner", owner).Msg("lock is not expired but same owner, refresh")
+		held = true
+		h.ValidUntil = timestamppb.New(validUntil)
+		if opts.Metadata != nil {
+			h.Metadata = opts.Metadata
+		}
+		h.Session = opts.Session
+		events = append(events, newEvent(pb.LockEvent_REFRESHED, key, lock, h))
+	case len(lock.Holders) == 0 && !queued && cdb.waiting(key):
+		cdb.log.Debug().Str("lock", key).Str("claimer", owner).Msg("lock is free but clients are waiting for it")
+	case len(lock.Holders) == 0, shared && lock.Shared && (queued || !cdb.exclusiveWaiting(key)):
+		seq, err := b.NextSequence()
+		if err != nil {
+			return nil, false, nil, fmt.Errorf("next fencing token: %w", err)
+		}
+		acquired, held = true, true
+		lock.Shared = shared
+		h = &pb.Holder{
+			Owner:        owner,
+			CreatedAt:    timestamppb.New(now),
+			ValidUntil:   timestamppb.New(validUntil),
+			FencingToken: seq,
+			Metadata:     opts.Metadata,
+			Session:      opts.Session,
+		}
+		lock.Holders = append(lock.Holders, h)
+		events = append(events, newEvent(pb.LockEvent_ACQUIRED, key, lock, h))
+	default:
+		cdb.log.Debug().Str("owner", lock.Holders[0].Owner).Str("claimer", owner).Msg("lock is already claimed")
+	}
+
+	if held && sess != nil {
+		if err := attachLock(sb, sess, key); err != nil {
+			return nil, false, nil, err
+		}
+	}
+
+	if len(events) == 0 {
+		summarize(lock)
+		return lock, false, nil, nil
+	}
+
+	return lock, acquired, events, saveLock(b, key, lock)
+}
+
+// RefreshLock delays the expiration of a lock owned by owner. Unlike ClaimLock
+// it never acquires the lock: ErrLockNotFound is returned if the lock doesn't
+// exist, ErrLockExpired if it already expired and ErrNotOwner if it is owned
+// by someone else. When no ttl is given, the configured default is used.
+// For shared locks, only the owner's expiration is delayed. Holds attached to
+// a session expire with it, ErrSessionBound is returned for them.
+func (cdb *CapybaraDB) RefreshLock(key, owner string, pttl *time.Duration) (*pb.Lock, error) {
+	start := time.Now()
+
+	ttl := cdb.defaultLockTTL
+	if pttl != nil {
 		ttl = *pttl
 	}
 
 	cdb.locksm.Lock()
 	defer cdb.locksm.Unlock()
 
-	lock := &pb.Lock{}
+	var events []*pb.LockEvent
+	var rerr error
+
+	var lock *pb.Lock
 	err := cdb.db.Update(func(t *bolt.Tx) error {
+		events = nil
+		rerr = nil
+
 		b := t.Bucket([]byte(LocksBucket))
 		if b == nil {
 			return ErrLocksBucketNotFound
 		}
 
-		// Check for lock existence
-		if raw := b.Get([]byte(key)); raw != nil {
-			// The lock exists
-			if err := proto.Unmarshal(raw, lock); err != nil {
-				return fmt.Errorf("proto unmarshal: %w", err)
-			}
+		var err error
+		if lock, err = loadLock(b, key); err != nil {
+			return err
+		}
 
-			// Lock is not expired
-			if lock.ValidUntil.AsTime().After(time.Now()) {
-				if lock.Owner == owner {
-					cdb.log.Debug().Str("lock", key).Str("owner", owner).Msg("lock is not expired but same owner, refresh")
-					lock.ValidUntil = timestamppb.New(time.Now().Add(ttl))
-					raw, err := proto.Marshal(lock)
-					if err != nil {
-						return fmt.Errorf("proto marshal: %w", err)
-					}
-					return b.Put([]byte(key), raw)
-				}
-				cdb.log.Debug().Str("owner", lock.Owner).Str("claimer", owner).Msg("lock is already claimed")
-				return nil
-			}
-			// Lock was expired, so we grant it
-			cdb.log.Debug().Str("lock", key).Msg("lock was expired, claim granted")
+		if len(lock.Holders) == 0 {
+			return ErrLockNotFound
 		}
 
-		// Insert lock
-		acquired = true
-		lock.Owner = owner
-		lock.CreatedAt = timestamppb.Now()
-		lock.ValidUntil = timestamppb.New(time.Now().Add(ttl))
-		raw, err := proto.Marshal(lock)
-		if err != nil {
-			return fmt.Errorf("proto marshal: %w", err)
+		expired := expireHolders(&lock.Holders, time.Now())
+		for _, h := range expired {
+			events = append(events, newEvent(pb.LockEvent_EXPIRED, key, lock, h))
+		}
+
+		h := findHolder(lock.Holders, owner)
+		switch {
+		case h != nil && h.Session != "":
+			rerr = ErrSessionBound
+		case h != nil:
+			h.ValidUntil = timestamppb.New(time.Now().Add(ttl))
+			events = append(events, newEvent(pb.LockEvent_REFRESHED, key, lock, h))
+		case findHolder(expired, owner) != nil:
+			rerr = ErrLockExpired
+		default:
+			rerr = ErrNotOwner
 		}
-		return b.Put([]byte(key), raw)
+
+		return saveLock(b, key, lock)
 	})
 
-	cdb.log.Debug().Str("took", time.Since(start).String()).Msg("lock claim completed")
+	cdb.log.Debug().Str("took", time.Since(start).String()).Msg("lock refresh completed")
 
-	return lock, acquired, err
+	if err != nil {
+		return nil, err
+	}
+
+	cdb.publish(events...)
+
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	return lock, nil
 }
 
-// ReleaseLock can be used to release (or free) a lock.
-func (cdb *CapybaraDB) ReleaseLock(key, owner string) error {
+// ForceReleaseLock releases the lock whoever holds it, and returns the
+// released holders. If owner isn't empty, only this holder is released.
+// ErrLockNotFound is returned if the lock isn't held, or if owner doesn't
+// hold it.
+func (cdb *CapybaraDB) ForceReleaseLock(key, owner string) ([]*pb.Holder, error) {
 	start := time.Now()
 
 	cdb.locksm.Lock()
 	defer cdb.locksm.Unlock()
 
+	var events []*pb.LockEvent
+	var released []*pb.Holder
+	var rerr error
+
 	err := cdb.db.Update(func(t *bolt.Tx) error {
+		events, released, rerr = nil, nil, nil
+
 		b := t.Bucket([]byte(LocksBucket))
 		if b == nil {
 			return ErrLocksBucketNotFound
 		}
 
-		raw := b.Get([]byte(key))
-		if raw == nil {
+		lock, err := loadLock(b, key)
+		if err != nil {
+			return err
+		}
+
+		if len(lock.Holders) == 0 {
 			return ErrLockNotFound
 		}
 
-		lock := &pb.Lock{}
-		if err := proto.Unmarshal(raw, lock); err != nil {
-			return fmt.Errorf("proto unmarshal: %w", err)
+		for _, h := range expireHolders(&lock.Holders, time.Now()) {
+			events = append(events, newEvent(pb.LockEvent_EXPIRED, key, lock, h))
 		}
 
-		// Lock is already expired and shouldn't be in database
-		if lock.ValidUntil.AsTime().Before(time.Now()) {
-			if err := b.Delete([]byte(key)); err != nil {
-				return fmt.Errorf("delete lock: %w", err)
+		lock.Holders = slices.DeleteFunc(lock.Holders, func(h *pb.Holder) bool {
+			if owner != "" && h.Owner != owner {
+				return false
 			}
-			return ErrLockNotFound
+			released = append(released, h)
+			return true
+		})
+		for _, h := range released {
+			events = append(events, newEvent(pb.LockEvent_RELEASED, key, lock, h))
 		}
 
-		// Check ownership
-		if lock.Owner != owner {
-			return ErrNotOwner
+		if len(released) == 0 {
+			rerr = ErrLockNotFound
 		}
 
-		// Actually delete the lock
-		if err := b.Delete([]byte(key)); err != nil {
-			return fmt.Errorf("delete lock: %w", err)
+		return saveLock(b, key, lock)
+	})
+
+	cdb.log.Debug().Str("took", time.Since(start).String()).Msg("lock forced release completed")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cdb.publish(events...)
+
+	return released, rerr
+}
+
+// ReleaseLock can be used to release (or free) a lock. For shared locks, only
+// the owner's hold is released, the lock being deleted once its last holder
+// is gone.
+func (cdb *CapybaraDB) ReleaseLock(key, owner string) error {
+	start := time.Now()
+
+	cdb.locksm.Lock()
+	defer cdb.locksm.Unlock()
+
+	var events []*pb.LockEvent
+	var res releaseResult
+
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(LocksBucket))
+		if b == nil {
+			return ErrLocksBucketNotFound
 		}
-		return nil
+
+		var err error
+		events, res, err = release(b, key, owner)
+		return err
 	})
 
 	cdb.log.Debug().Str("took", time.Since(start).String()).Msg("lock release completed")
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	cdb.publish(events...)
+
+	return res.err()
+}
+
+// releaseResult is the outcome of a release.
+type releaseResult int
+
+const (
+	// released means the owner's hold was released.
+	released releaseResult = iota
+	// releaseNotFound means the lock isn't held, or the owner's hold expired.
+	releaseNotFound
+	// releaseNotOwner means the lock is held by someone else.
+	releaseNotOwner
+)
+
+// err returns the error reported to the caller of a release with this
+// outcome: nil, ErrLockNotFound or ErrNotOwner.
+func (r releaseResult) err() error {
+	switch r {
+	case releaseNotFound:
+		return ErrLockNotFound
+	case releaseNotOwner:
+		return ErrNotOwner
+	}
+
+	return nil
+}
+
+// release releases owner's hold on the lock within the transaction of the
+// locks bucket and returns the events to publish once the transaction is
+// committed. The caller must only fail the transaction if an error is
+// returned.
+func release(b *bolt.Bucket, key, owner string) ([]*pb.LockEvent, releaseResult, error) {
+	var events []*pb.LockEvent
+
+	lock, err := loadLock(b, key)
+	if err != nil {
+		return nil, releaseNotFound, err
+	}
+
+	if len(lock.Holders) == 0 {
+		return nil, releaseNotFound, nil
+	}
+
+	expired := expireHolders(&lock.Holders, time.Now())
+	for _, h := range expired {
+		events = append(events, newEvent(pb.LockEvent_EXPIRED, key, lock, h))
+	}
+
+	res := released
+	h := findHolder(lock.Holders, owner)
+	switch {
+	case h != nil:
+		lock.Holders = slices.DeleteFunc(lock.Holders, func(o *pb.Holder) bool { return o == h })
+		events = append(events, newEvent(pb.LockEvent_RELEASED, key, lock, h))
+	case len(lock.Holders) == 0 || findHolder(expired, owner) != nil:
+		res = releaseNotFound
+	default:
+		res = releaseNotOwner
+	}
+
+	return events, res, saveLock(b, key, lock)
 }
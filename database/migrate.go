@@ -0,0 +1,158 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/depado/capybara/pb"
+)
+
+// schemaVersion is the version of the storage format. Version 1 stores kv
+// values in a pb.Entry envelope, raw values being stored before.
+const schemaVersion = 1
+
+// schemaVersionKey is the key of the schema version in the meta bucket.
+var schemaVersionKey = []byte("schema_version")
+
+// ErrReservedBucket is the error returned on startup when a bucket reserved
+// for capybara's internal use already holds user data.
+var ErrReservedBucket = errors.New("reserved bucket holds user data")
+
+// storedSchemaVersion returns the schema version of the database, 0 if it
+// predates the versioning of the storage format.
+func storedSchemaVersion(t *bolt.Tx) uint64 {
+	mb := t.Bucket([]byte(MetaBucket))
+	if mb == nil {
+		return 0
+	}
+
+	raw := mb.Get(schemaVersionKey)
+	if raw == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(raw)
+}
+
+// checkReservedBuckets returns an error if one of the internal buckets,
+// reserved since the first schema version, already holds user data. Such a
+// bucket would become unreachable through the kv operations.
+func checkReservedBuckets(t *bolt.Tx) error {
+	for _, name := range internalBuckets {
+		// The locks bucket was reserved before the schema was versioned
+		if name == LocksBucket {
+			continue
+		}
+
+		b := t.Bucket([]byte(name))
+		if b == nil {
+			continue
+		}
+		if k, _ := b.Cursor().First(); k != nil {
+			return fmt.Errorf("%w: bucket %s is reserved, rename it before upgrading", ErrReservedBucket, name)
+		}
+	}
+
+	return nil
+}
+
+// migrate upgrades the storage format to the current schema version, and
+// returns the number of migrated kv entries.
+func migrate(t *bolt.Tx) (int, error) {
+	mb := t.Bucket([]byte(MetaBucket))
+	if mb == nil {
+		return 0, ErrMetaBucketNotFound
+	}
+
+	version := storedSchemaVersion(t)
+	if version > schemaVersion {
+		return 0, fmt.Errorf("schema version %d is newer than the supported version %d", version, schemaVersion)
+	}
+
+	var migrated int
+	if version < 1 {
+		var err error
+		if migrated, err = migrateEntries(t); err != nil {
+			return 0, fmt.Errorf("migrate to version 1: %w", err)
+		}
+	}
+
+	return migrated, mb.Put(schemaVersionKey, binary.BigEndian.AppendUint64(nil, schemaVersion))
+}
+
+// migrateEntries wraps the raw kv values in an entry, each of them being
+// given a new revision.
+func migrateEntries(t *bolt.Tx) (int, error) {
+	var names []string
+	err := t.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if !IsInternalBucket(string(name)) {
+			names = append(names, string(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var migrated int
+	for _, name := range names {
+		n, err := migrateBucket(t, t.Bucket([]byte(name)))
+		if err != nil {
+			return 0, fmt.Errorf("bucket %s: %w", name, err)
+		}
+		migrated += n
+	}
+
+	return migrated, nil
+}
+
+// migrateBucket wraps the raw values of the bucket, and of its nested buckets,
+// in an entry.
+func migrateBucket(t *bolt.Tx, b *bolt.Bucket) (int, error) {
+	var nested []string
+
+	now := timestamppb.Now()
+	migrated, err := updateEach(b, func(k, v []byte) ([]byte, bool, error) {
+		if v == nil {
+			nested = append(nested, string(k))
+			return nil, false, nil
+		}
+		return slices.Clone(v), true, nil
+	}, func(k string, value []byte) error {
+		rev, err := nextRevision(t)
+		if err != nil {
+			return err
+		}
+
+		e := &pb.Entry{
+			Value:          value,
+			CreateRevision: rev,
+			ModRevision:    rev,
+			Version:        1,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		}
+		if err := saveEntry(b, k, e); err != nil {
+			return fmt.Errorf("key %s: %w", k, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range nested {
+		n, err := migrateBucket(t, b.Bucket([]byte(name)))
+		if err != nil {
+			return 0, fmt.Errorf("bucket %s: %w", name, err)
+		}
+		migrated += n
+	}
+
+	return migrated, nil
+}
@@ -0,0 +1,203 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/depado/capybara/cmd"
+)
+
+// baselineDB writes a database in the format predating the schema versioning
+// to a temporary directory and returns its path: raw values in user buckets
+// and a locks bucket as the only internal bucket.
+func baselineDB(t *testing.T, fill func(t *bolt.Tx) error) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "capybara.db")
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("open baseline database: %v", err)
+	}
+	err = db.Update(func(t *bolt.Tx) error {
+		if _, err := t.CreateBucket([]byte(LocksBucket)); err != nil {
+			return err
+		}
+		return fill(t)
+	})
+	if err != nil {
+		t.Fatalf("fill baseline database: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close baseline database: %v", err)
+	}
+
+	return path
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	path := baselineDB(t, func(t *bolt.Tx) error {
+		guilds, err := t.CreateBucket([]byte("guilds"))
+		if err != nil {
+			return err
+		}
+		if err := guilds.Put([]byte("a"), []byte("alpha")); err != nil {
+			return err
+		}
+		if err := guilds.Put([]byte("b"), []byte("bravo")); err != nil {
+			return err
+		}
+
+		members, err := guilds.CreateBucket([]byte("members"))
+		if err != nil {
+			return err
+		}
+		return members.Put([]byte("c"), []byte("charlie"))
+	})
+
+	keys := []struct {
+		buckets []string
+		key     string
+		value   string
+	}{
+		{[]string{"guilds"}, "a", "alpha"},
+		{[]string{"guilds"}, "b", "bravo"},
+		{[]string{"guilds", "members"}, "c", "charlie"},
+	}
+
+	cdb := openTestDB(t, path)
+
+	revisions := make(map[uint64]bool)
+	for _, k := range keys {
+		e, err := cdb.GetEntry(k.buckets, k.key)
+		if err != nil {
+			t.Fatalf("get %v/%s: %v", k.buckets, k.key, err)
+		}
+
+		if string(e.Value) != k.value {
+			t.Errorf("%v/%s: expected value %q, got %q", k.buckets, k.key, k.value, e.Value)
+		}
+		if e.ModRevision == 0 || e.CreateRevision != e.ModRevision {
+			t.Errorf("%v/%s: expected equal non zero revisions, got create %d and mod %d", k.buckets, k.key, e.CreateRevision, e.ModRevision)
+		}
+		if revisions[e.ModRevision] {
+			t.Errorf("%v/%s: revision %d given twice", k.buckets, k.key, e.ModRevision)
+		}
+		revisions[e.ModRevision] = true
+		if e.Version != 1 {
+			t.Errorf("%v/%s: expected version 1, got %d", k.buckets, k.key, e.Version)
+		}
+		if e.CreatedAt == nil || e.UpdatedAt == nil {
+			t.Errorf("%v/%s: missing creation or update date", k.buckets, k.key)
+		}
+	}
+
+	var version uint64
+	err := cdb.db.View(func(t *bolt.Tx) error {
+		version = storedSchemaVersion(t)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("read schema version: %v", err)
+	}
+	if version != schemaVersion {
+		t.Errorf("expected schema version %d, got %d", schemaVersion, version)
+	}
+
+	first, err := cdb.GetEntry([]string{"guilds"}, "a")
+	if err != nil {
+		t.Fatalf("get guilds/a: %v", err)
+	}
+	if err := cdb.Close(); err != nil {
+		t.Fatalf("close database: %v", err)
+	}
+
+	// Reopening the database doesn't migrate the entries again
+	cdb = openTestDB(t, path)
+	e, err := cdb.GetEntry([]string{"guilds"}, "a")
+	if err != nil {
+		t.Fatalf("get guilds/a after reopening: %v", err)
+	}
+	if string(e.Value) != "alpha" || e.ModRevision != first.ModRevision || e.Version != 1 {
+		t.Errorf("entry changed after reopening: %v, was %v", e, first)
+	}
+}
+
+func TestMigrateReservedBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		fill    func(t *bolt.Tx) error
+		wantErr error
+	}{
+		{
+			name: "empty reserved bucket",
+			fill: func(t *bolt.Tx) error {
+				_, err := t.CreateBucket([]byte(SessionsBucket))
+				return err
+			},
+		},
+		{
+			name: "reserved bucket with data",
+			fill: func(t *bolt.Tx) error {
+				b, err := t.CreateBucket([]byte(MetaBucket))
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte("key"), []byte("value"))
+			},
+			wantErr: ErrReservedBucket,
+		},
+		{
+			name: "reserved bucket with a nested bucket",
+			fill: func(t *bolt.Tx) error {
+				b, err := t.CreateBucket([]byte(TokensBucket))
+				if err != nil {
+					return err
+				}
+				_, err = b.CreateBucket([]byte("nested"))
+				return err
+			},
+			wantErr: ErrReservedBucket,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := baselineDB(t, tt.fill)
+
+			conf := &cmd.Conf{Database: cmd.DatabaseConf{Path: path, DefaultLockTTL: time.Minute}}
+			cdb, err := NewCapybaraDB(conf, zerolog.Nop())
+			if err == nil {
+				defer cdb.Close() //nolint:errcheck
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestMigrateNewerVersion checks that a database written by a newer version
+// isn't opened.
+func TestMigrateNewerVersion(t *testing.T) {
+	path := baselineDB(t, func(t *bolt.Tx) error {
+		b, err := t.CreateBucket([]byte(MetaBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put(schemaVersionKey, binary.BigEndian.AppendUint64(nil, schemaVersion+1))
+	})
+
+	conf := &cmd.Conf{Database: cmd.DatabaseConf{Path: path, DefaultLockTTL: time.Minute}}
+	cdb, err := NewCapybaraDB(conf, zerolog.Nop())
+	if err == nil {
+		cdb.Close() //nolint:errcheck
+		t.Fatal("expected the database to be rejected")
+	}
+}
@@ -0,0 +1,165 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/depado/capybara/pb"
+)
+
+// ErrSemaphoreNotFound is the error returned when a semaphore can't be found.
+var ErrSemaphoreNotFound = errors.New("semaphore not found")
+
+// ErrPermitsMismatch is the error returned when acquiring a semaphore with a
+// number of permits other than the one it is held with.
+var ErrPermitsMismatch = errors.New("permits don't match the semaphore")
+
+// loadSemaphore reads the semaphore stored at key. An empty semaphore is
+// returned if there is none.
+func loadSemaphore(b *bolt.Bucket, key string) (*pb.Semaphore, error) {
+	sem := &pb.Semaphore{}
+
+	if raw := b.Get([]byte(key)); raw != nil {
+		if err := proto.Unmarshal(raw, sem); err != nil {
+			return nil, fmt.Errorf("proto unmarshal: %w", err)
+		}
+	}
+
+	return sem, nil
+}
+
+// saveSemaphore stores the semaphore at key, or deletes it if it has no
+// holder left.
+func saveSemaphore(b *bolt.Bucket, key string, sem *pb.Semaphore) error {
+	if len(sem.Holders) == 0 {
+		if err := b.Delete([]byte(key)); err != nil {
+			return fmt.Errorf("delete semaphore: %w", err)
+		}
+		return nil
+	}
+
+	raw, err := proto.Marshal(sem)
+	if err != nil {
+		return fmt.Errorf("proto marshal: %w", err)
+	}
+
+	return b.Put([]byte(key), raw)
+}
+
+// AcquireSemaphore acquires one of the permits of the semaphore. Like locks,
+// each holder has its own expiration, and acquiring a permit that is already
+// held by owner delays its expiration. When no ttl is given, the configured
+// default is used. The number of permits is set when the semaphore is
+// created, and can only be changed once it has no holder left:
+// ErrPermitsMismatch is returned if it is held with a different number of
+// permits.
+func (cdb *CapybaraDB) AcquireSemaphore(key, owner string, permits uint32, pttl *time.Duration) (*pb.Semaphore, bool, error) {
+	start := time.Now()
+
+	ttl := cdb.defaultLockTTL
+	if pttl != nil {
+		ttl = *pttl
+	}
+
+	var acquired bool
+
+	var sem *pb.Semaphore
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		acquired = false
+
+		b := t.Bucket([]byte(SemaphoresBucket))
+		if b == nil {
+			return ErrSemaphoresBucketNotFound
+		}
+
+		var err error
+		if sem, err = loadSemaphore(b, key); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, h := range expireHolders(&sem.Holders, now) {
+			cdb.log.Debug().Str("semaphore", key).Str("owner", h.Owner).Msg("semaphore holder expired")
+		}
+
+		if len(sem.Holders) > 0 && sem.Permits != permits {
+			return fmt.Errorf("%w: held with %d permits", ErrPermitsMismatch, sem.Permits)
+		}
+
+		sem.Permits = permits
+		if h := findHolder(sem.Holders, owner); h != nil {
+			cdb.log.Debug().Str("semaphore", key).Str("owner", owner).Msg("permit already held, refresh")
+			h.ValidUntil = timestamppb.New(now.Add(ttl))
+		} else if len(sem.Holders) < int(permits) {
+			acquired = true
+			sem.Holders = append(sem.Holders, &pb.Holder{
+				Owner:      owner,
+				CreatedAt:  timestamppb.New(now),
+				ValidUntil: timestamppb.New(now.Add(ttl)),
+			})
+		} else {
+			cdb.log.Debug().Str("semaphore", key).Str("claimer", owner).Msg("no permit left")
+		}
+
+		return saveSemaphore(b, key, sem)
+	})
+
+	cdb.log.Debug().Str("took", time.Since(start).String()).Msg("semaphore acquire completed")
+
+	return sem, acquired, err
+}
+
+// ReleaseSemaphore releases the permit held by owner. ErrSemaphoreNotFound is
+// returned if the semaphore doesn't exist or owner's permit expired, and
+// ErrNotOwner if owner doesn't hold a permit.
+func (cdb *CapybaraDB) ReleaseSemaphore(key, owner string) error {
+	start := time.Now()
+
+	var rerr error
+
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		rerr = nil
+
+		b := t.Bucket([]byte(SemaphoresBucket))
+		if b == nil {
+			return ErrSemaphoresBucketNotFound
+		}
+
+		sem, err := loadSemaphore(b, key)
+		if err != nil {
+			return err
+		}
+
+		if len(sem.Holders) == 0 {
+			return ErrSemaphoreNotFound
+		}
+
+		expired := expireHolders(&sem.Holders, time.Now())
+
+		h := findHolder(sem.Holders, owner)
+		switch {
+		case h != nil:
+			sem.Holders = slices.DeleteFunc(sem.Holders, func(o *pb.Holder) bool { return o == h })
+		case len(sem.Holders) == 0 || findHolder(expired, owner) != nil:
+			rerr = ErrSemaphoreNotFound
+		default:
+			rerr = ErrNotOwner
+		}
+
+		return saveSemaphore(b, key, sem)
+	})
+
+	cdb.log.Debug().Str("took", time.Since(start).String()).Msg("semaphore release completed")
+
+	if err != nil {
+		return err
+	}
+
+	return rerr
+}
@@ -0,0 +1,357 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/depado/capybara/pb"
+)
+
+// ErrSessionNotFound is the error returned when a session can't be found.
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrSessionExpired is the error returned when using a session that already
+// expired.
+var ErrSessionExpired = errors.New("session expired")
+
+// loadSession reads the session stored at id. ErrSessionNotFound is returned
+// if there is none.
+func loadSession(b *bolt.Bucket, id string) (*pb.Session, error) {
+	raw := b.Get([]byte(id))
+	if raw == nil {
+		return nil, ErrSessionNotFound
+	}
+
+	sess := &pb.Session{}
+	if err := proto.Unmarshal(raw, sess); err != nil {
+		return nil, fmt.Errorf("proto unmarshal: %w", err)
+	}
+
+	return sess, nil
+}
+
+// saveSession stores the session.
+func saveSession(b *bolt.Bucket, sess *pb.Session) error {
+	raw, err := proto.Marshal(sess)
+	if err != nil {
+		return fmt.Errorf("proto marshal: %w", err)
+	}
+
+	return b.Put([]byte(sess.Id), raw)
+}
+
+// activeSession returns the session stored at id along with its bucket.
+// ErrSessionNotFound is returned if there is no such session, and
+// ErrSessionExpired if it expired.
+func activeSession(t *bolt.Tx, id string) (*bolt.Bucket, *pb.Session, error) {
+	b := t.Bucket([]byte(SessionsBucket))
+	if b == nil {
+		return nil, nil, ErrSessionsBucketNotFound
+	}
+
+	sess, err := loadSession(b, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !sess.ValidUntil.AsTime().After(time.Now()) {
+		return nil, nil, ErrSessionExpired
+	}
+
+	return b, sess, nil
+}
+
+// checkSessionOwner returns ErrNotOwner unless the session is owned by owner
+// and was created with the named token. An empty token matches any token.
+func checkSessionOwner(sess *pb.Session, owner, token string) error {
+	if sess.Owner != owner || (token != "" && sess.Token != token) {
+		return ErrNotOwner
+	}
+
+	return nil
+}
+
+// attachLock records that the session holds the lock stored at key.
+func attachLock(b *bolt.Bucket, sess *pb.Session, key string) error {
+	if slices.Contains(sess.Locks, key) {
+		return nil
+	}
+
+	sess.Locks = append(sess.Locks, key)
+	return saveSession(b, sess)
+}
+
+// attachKey records that the kv entry must be deleted when the session ends,
+// unless it is written again without the session.
+func attachKey(b *bolt.Bucket, sess *pb.Session, buckets []string, key string) error {
+	if slices.ContainsFunc(sess.Keys, func(k *pb.SessionKey) bool {
+		return k.Key == key && slices.Equal(k.Buckets, buckets)
+	}) {
+		return nil
+	}
+
+	sess.Keys = append(sess.Keys, &pb.SessionKey{Buckets: buckets, Key: key})
+	return saveSession(b, sess)
+}
+
+// endSession releases the locks held through the session, deletes the kv
+// entries last written with it and the session itself. The released holds are reported with the
+// given event type.
+func endSession(t *bolt.Tx, sess *pb.Session, typ pb.LockEvent_Type) ([]*pb.LockEvent, error) {
+	var events []*pb.LockEvent
+
+	lb := t.Bucket([]byte(LocksBucket))
+	if lb == nil {
+		return nil, ErrLocksBucketNotFound
+	}
+
+	for _, k := range sess.Locks {
+		lock, err := loadLock(lb, k)
+		if err != nil {
+			return nil, fmt.Errorf("lock %s: %w", k, err)
+		}
+
+		var released []*pb.Holder
+		lock.Holders = slices.DeleteFunc(lock.Holders, func(h *pb.Holder) bool {
+			if h.Session != sess.Id {
+				return false
+			}
+			released = append(released, h)
+			return true
+		})
+		if len(released) == 0 {
+			continue
+		}
+
+		for _, h := range released {
+			events = append(events, newEvent(typ, k, lock, h))
+		}
+		if err := saveLock(lb, k, lock); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, k := range sess.Keys {
+		b, err := Traverse(t, k.Buckets)
+		if errors.Is(err, ErrBucketNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The key was replaced by a bucket in the meantime
+		if b.Bucket([]byte(k.Key)) != nil {
+			continue
+		}
+		// The key was written again without the session in the meantime
+		e, err := loadEntry(b, k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", k.Key, err)
+		}
+		if e.GetSession() != sess.Id {
+			continue
+		}
+		if err := b.Delete([]byte(k.Key)); err != nil {
+			return nil, fmt.Errorf("delete key %s: %w", k.Key, err)
+		}
+		if err := deleteKeyMeta(t, k.Buckets, k.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	sb := t.Bucket([]byte(SessionsBucket))
+	if sb == nil {
+		return nil, ErrSessionsBucketNotFound
+	}
+
+	return events, sb.Delete([]byte(sess.Id))
+}
+
+// CreateSession creates a session owned by owner, created with the named
+// token. Locks and kv entries
+// attached to the session are released and deleted when it is closed, or
+// when it expires because it wasn't kept alive for ttl. When no ttl is given,
+// the configured lock default is used.
+func (cdb *CapybaraDB) CreateSession(owner, token string, pttl *time.Duration) (*pb.Session, error) {
+	ttl := cdb.defaultLockTTL
+	if pttl != nil {
+		ttl = *pttl
+	}
+
+	now := time.Now()
+	sess := &pb.Session{
+		Id:         uuid.NewString(),
+		Owner:      owner,
+		Token:      token,
+		Ttl:        durationpb.New(ttl),
+		CreatedAt:  timestamppb.New(now),
+		ValidUntil: timestamppb.New(now.Add(ttl)),
+	}
+
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(SessionsBucket))
+		if b == nil {
+			return ErrSessionsBucketNotFound
+		}
+		return saveSession(b, sess)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cdb.log.Debug().Str("session", sess.Id).Str("owner", owner).Msg("session created")
+
+	return sess, nil
+}
+
+// KeepAliveSession delays the expiration of the session, and of every lock
+// held through it, by the session's ttl. ErrSessionNotFound is returned if
+// the session doesn't exist, ErrNotOwner if it isn't owned by owner with the
+// named token, any token matching if empty, and ErrSessionExpired if it
+// already expired, in which case it is ended.
+func (cdb *CapybaraDB) KeepAliveSession(id, owner, token string) (*pb.Session, error) {
+	start := time.Now()
+
+	cdb.locksm.Lock()
+	defer cdb.locksm.Unlock()
+
+	var events []*pb.LockEvent
+	var rerr error
+
+	var sess *pb.Session
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		events, rerr = nil, nil
+
+		b := t.Bucket([]byte(SessionsBucket))
+		if b == nil {
+			return ErrSessionsBucketNotFound
+		}
+
+		var err error
+		if sess, err = loadSession(b, id); err != nil {
+			return err
+		}
+
+		if err := checkSessionOwner(sess, owner, token); err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		// The expired session is ended along with the keep alive, which then
+		// fails with rerr
+		if !sess.ValidUntil.AsTime().After(now) {
+			rerr = ErrSessionExpired
+			events, err = endSession(t, sess, pb.LockEvent_EXPIRED)
+			return err
+		}
+
+		lb := t.Bucket([]byte(LocksBucket))
+		if lb == nil {
+			return ErrLocksBucketNotFound
+		}
+
+		sess.ValidUntil = timestamppb.New(now.Add(sess.Ttl.AsDuration()))
+
+		// Locks released since they were claimed are forgotten
+		held := sess.Locks[:0]
+		for _, k := range sess.Locks {
+			lock, err := loadLock(lb, k)
+			if err != nil {
+				return fmt.Errorf("lock %s: %w", k, err)
+			}
+
+			for _, h := range expireHolders(&lock.Holders, now) {
+				events = append(events, newEvent(pb.LockEvent_EXPIRED, k, lock, h))
+			}
+
+			var refreshed bool
+			for _, h := range lock.Holders {
+				if h.Session == sess.Id {
+					h.ValidUntil = sess.ValidUntil
+					events = append(events, newEvent(pb.LockEvent_REFRESHED, k, lock, h))
+					refreshed = true
+				}
+			}
+			if refreshed {
+				held = append(held, k)
+			}
+
+			if err := saveLock(lb, k, lock); err != nil {
+				return err
+			}
+		}
+		sess.Locks = held
+
+		return saveSession(b, sess)
+	})
+
+	cdb.log.Debug().Str("took", time.Since(start).String()).Msg("session keep alive completed")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cdb.publish(events...)
+
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	return sess, nil
+}
+
+// CloseSession ends the session, releasing the locks held through it and
+// deleting its kv entries. ErrSessionNotFound is returned if the session
+// doesn't exist, and ErrNotOwner if it isn't owned by owner with the named
+// token, any token matching if empty.
+func (cdb *CapybaraDB) CloseSession(id, owner, token string) error {
+	start := time.Now()
+
+	cdb.locksm.Lock()
+	defer cdb.locksm.Unlock()
+
+	var events []*pb.LockEvent
+
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(SessionsBucket))
+		if b == nil {
+			return ErrSessionsBucketNotFound
+		}
+
+		sess, err := loadSession(b, id)
+		if err != nil {
+			return err
+		}
+
+		if err := checkSessionOwner(sess, owner, token); err != nil {
+			return err
+		}
+
+		typ := pb.LockEvent_RELEASED
+		if !sess.ValidUntil.AsTime().After(time.Now()) {
+			typ = pb.LockEvent_EXPIRED
+		}
+
+		events, err = endSession(t, sess, typ)
+		return err
+	})
+
+	cdb.log.Debug().Str("took", time.Since(start).String()).Msg("session close completed")
+
+	if err != nil {
+		return err
+	}
+
+	cdb.publish(events...)
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessionOwner(t *testing.T) {
+	cdb := newTestDB(t)
+
+	sess, err := cdb.CreateSession("owner", "token", nil)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		owner   string
+		token   string
+		wantErr error
+	}{
+		{"owner with its token", "owner", "token", nil},
+		{"any token", "owner", "", nil},
+		{"another token", "owner", "other", ErrNotOwner},
+		{"another owner", "other", "token", ErrNotOwner},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := cdb.KeepAliveSession(sess.Id, tt.owner, tt.token); !errors.Is(err, tt.wantErr) {
+				t.Errorf("keep alive: expected error %v, got %v", tt.wantErr, err)
+			}
+
+			_, _, err := cdb.ClaimLock("lock", tt.owner, ClaimOptions{Session: sess.Id, Token: tt.token})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("claim lock: expected error %v, got %v", tt.wantErr, err)
+			}
+
+			_, err = cdb.PutWithOptions([]string{"kv"}, "key", []byte("value"), PutOptions{Session: sess.Id, Owner: tt.owner, Token: tt.token})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("put: expected error %v, got %v", tt.wantErr, err)
+			}
+
+			// The session can't be closed by someone else
+			if tt.wantErr != nil {
+				if err := cdb.CloseSession(sess.Id, tt.owner, tt.token); !errors.Is(err, tt.wantErr) {
+					t.Errorf("close: expected error %v, got %v", tt.wantErr, err)
+				}
+			}
+		})
+	}
+
+	if err := cdb.CloseSession(sess.Id, "owner", "token"); err != nil {
+		t.Fatalf("close session: %v", err)
+	}
+	if _, err := cdb.GetEntry([]string{"kv"}, "key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected the session key to be deleted, got %v", err)
+	}
+}
+
+// TestSessionKeyExpiry checks that the kv entries attached to a session can't
+// be read once it expired, even though the sweeper didn't delete them yet.
+func TestSessionKeyExpiry(t *testing.T) {
+	cdb := newTestDB(t)
+
+	ttl := 50 * time.Millisecond
+	sess, err := cdb.CreateSession("owner", "token", &ttl)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	bucket := []string{"kv"}
+	if _, err := cdb.PutWithOptions(bucket, "key", []byte("value"), PutOptions{Session: sess.Id, Owner: "owner", Token: "token"}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if e, err := cdb.GetEntry(bucket, "key"); err != nil || string(e.Value) != "value" {
+		t.Fatalf("expected to read value, got %v, %v", e, err)
+	}
+
+	time.Sleep(2 * ttl)
+
+	if _, err := cdb.GetEntry(bucket, "key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("get: expected %v, got %v", ErrKeyNotFound, err)
+	}
+
+	_, results, err := cdb.Txn(nil, []TxnOp{{Type: TxnRange, Buckets: bucket, Limit: 10}}, nil)
+	if err != nil {
+		t.Fatalf("range: %v", err)
+	}
+	if len(results[0].Entries) != 0 {
+		t.Errorf("range: expected no entries, got %v", results[0].Entries)
+	}
+
+	// Writing the key again creates a new entry
+	if _, err := cdb.PutWithOptions(bucket, "key", []byte("again"), PutOptions{IfAbsent: true}); err != nil {
+		t.Fatalf("put again: %v", err)
+	}
+	e, err := cdb.GetEntry(bucket, "key")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if string(e.Value) != "again" || e.Version != 1 || e.Session != "" {
+		t.Errorf("expected a new entry, got %v", e)
+	}
+}
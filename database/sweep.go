@@ -0,0 +1,238 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/depado/capybara/pb"
+)
+
+// sweepLocks deletes the expired holders from the locks bucket, and the locks
+// left without holders. It returns the number of expired holders along with
+// the number of remaining locks.
+func (cdb *CapybaraDB) sweepLocks() (int, int, error) {
+	cdb.locksm.Lock()
+	defer cdb.locksm.Unlock()
+
+	var events []*pb.LockEvent
+	var remaining int
+
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		events = nil
+		remaining = 0
+
+		b := t.Bucket([]byte(LocksBucket))
+		if b == nil {
+			return ErrLocksBucketNotFound
+		}
+
+		now := time.Now()
+		_, err := updateEach(b, func(k, _ []byte) (*pb.Lock, bool, error) {
+			lock, err := loadLock(b, string(k))
+			if err != nil {
+				return nil, false, fmt.Errorf("lock %s: %w", k, err)
+			}
+			expired := expireHolders(&lock.Holders, now)
+			if len(lock.Holders) > 0 {
+				remaining++
+			}
+			for _, h := range expired {
+				events = append(events, newEvent(pb.LockEvent_EXPIRED, string(k), lock, h))
+			}
+			return lock, len(expired) > 0, nil
+		}, func(k string, lock *pb.Lock) error {
+			return saveLock(b, k, lock)
+		})
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cdb.publish(events...)
+
+	return len(events), remaining, nil
+}
+
+// sweepSemaphores deletes the expired holders from the semaphores bucket, and
+// the semaphores left without holders. It returns the number of expired
+// holders along with the number of remaining semaphores.
+func (cdb *CapybaraDB) sweepSemaphores() (int, int, error) {
+	var swept, remaining int
+
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		swept, remaining = 0, 0
+
+		b := t.Bucket([]byte(SemaphoresBucket))
+		if b == nil {
+			return ErrSemaphoresBucketNotFound
+		}
+
+		now := time.Now()
+		_, err := updateEach(b, func(k, _ []byte) (*pb.Semaphore, bool, error) {
+			sem, err := loadSemaphore(b, string(k))
+			if err != nil {
+				return nil, false, fmt.Errorf("semaphore %s: %w", k, err)
+			}
+			expired := expireHolders(&sem.Holders, now)
+			if len(sem.Holders) > 0 {
+				remaining++
+			}
+			swept += len(expired)
+			return sem, len(expired) > 0, nil
+		}, func(k string, sem *pb.Semaphore) error {
+			return saveSemaphore(b, k, sem)
+		})
+		return err
+	})
+
+	return swept, remaining, err
+}
+
+// sweepSessions ends the expired sessions, releasing their locks and deleting
+// their kv entries. It returns the number of ended sessions along with the
+// number of remaining sessions.
+func (cdb *CapybaraDB) sweepSessions() (int, int, error) {
+	cdb.locksm.Lock()
+	defer cdb.locksm.Unlock()
+
+	var events []*pb.LockEvent
+	var swept, remaining int
+
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		events = nil
+		swept, remaining = 0, 0
+
+		b := t.Bucket([]byte(SessionsBucket))
+		if b == nil {
+			return ErrSessionsBucketNotFound
+		}
+
+		now := time.Now()
+		var err error
+		swept, err = updateEach(b, func(k, _ []byte) (*pb.Session, bool, error) {
+			sess, err := loadSession(b, string(k))
+			if err != nil {
+				return nil, false, fmt.Errorf("session %s: %w", k, err)
+			}
+			if sess.ValidUntil.AsTime().After(now) {
+				remaining++
+				return nil, false, nil
+			}
+			return sess, true, nil
+		}, func(_ string, sess *pb.Session) error {
+			evs, err := endSession(t, sess, pb.LockEvent_EXPIRED)
+			if err != nil {
+				return fmt.Errorf("session %s: %w", sess.Id, err)
+			}
+			events = append(events, evs...)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cdb.publish(events...)
+
+	return swept, remaining, nil
+}
+
+// sweepKeys deletes the expired kv entries. It returns the number of deleted
+// entries along with the number of remaining entries that expire.
+func (cdb *CapybaraDB) sweepKeys() (int, int, error) {
+	var swept, remaining int
+
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		swept, remaining = 0, 0
+
+		mb := t.Bucket([]byte(KVMetaBucket))
+		if mb == nil {
+			return ErrKVMetaBucketNotFound
+		}
+
+		now := time.Now()
+		var err error
+		swept, err = updateEach(mb, func(k, v []byte) (*pb.KeyMeta, bool, error) {
+			meta := &pb.KeyMeta{}
+			if err := proto.Unmarshal(v, meta); err != nil {
+				return nil, false, fmt.Errorf("key meta %q: proto unmarshal: %w", k, err)
+			}
+			switch {
+			case meta.ValidUntil == nil:
+			case keyExpired(meta, now):
+				return meta, true, nil
+			default:
+				remaining++
+			}
+			return nil, false, nil
+		}, func(_ string, meta *pb.KeyMeta) error {
+			b, err := Traverse(t, meta.Buckets)
+			switch {
+			case errors.Is(err, ErrBucketNotFound):
+			case err != nil:
+				return err
+			case b.Bucket([]byte(meta.Key)) == nil:
+				if err := b.Delete([]byte(meta.Key)); err != nil {
+					return fmt.Errorf("delete key %s: %w", meta.Key, err)
+				}
+			}
+			return deleteKeyMeta(t, meta.Buckets, meta.Key)
+		})
+		return err
+	})
+
+	return swept, remaining, err
+}
+
+// sweeper periodically deletes the expired locks, semaphore holders and kv
+// entries, and ends the expired sessions, until the database is closed. A
+// failed sweep is logged and doesn't prevent the following ones from running.
+func (cdb *CapybaraDB) sweeper(interval time.Duration) {
+	defer cdb.sweepwg.Done()
+
+	log := cdb.log.With().Str("function", "sweeper").Logger()
+	log.Debug().Str("interval", interval.String()).Msg("started")
+
+	sweeps := []struct {
+		name  string
+		sweep func() (int, int, error)
+	}{
+		{"locks", cdb.sweepLocks},
+		{"semaphore holders", cdb.sweepSemaphores},
+		{"sessions", cdb.sweepSessions},
+		{"keys", cdb.sweepKeys},
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-cdb.stop:
+			log.Debug().Msg("stopped")
+			return
+		case <-t.C:
+		}
+
+		for _, s := range sweeps {
+			start := time.Now()
+			swept, remaining, err := s.sweep()
+			if err != nil {
+				log.Err(err).Msg("unable to sweep expired " + s.name)
+				continue
+			}
+
+			ev := log.Debug()
+			if swept > 0 {
+				ev = log.Info()
+			}
+			ev.Int("swept", swept).Int("remaining", remaining).Str("took", time.Since(start).String()).Msg("swept expired " + s.name)
+		}
+	}
+}
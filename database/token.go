@@ -0,0 +1,290 @@
+package database
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/depado/capybara/cmd"
+	"github.com/depado/capybara/pb"
+)
+
+var (
+	// ErrTokenNotFound is the error returned when a token can't be found.
+	ErrTokenNotFound = errors.New("token not found")
+	// ErrTokenExists is the error returned when creating a token with a name
+	// that is already used.
+	ErrTokenExists = errors.New("token already exists")
+	// ErrTokenExpired is the error returned when authenticating with an
+	// expired token.
+	ErrTokenExpired = errors.New("token expired")
+	// ErrTokenRevoked is the error returned when authenticating with a revoked
+	// token.
+	ErrTokenRevoked = errors.New("token revoked")
+)
+
+// putToken stores the token in the tokens bucket.
+func putToken(b *bolt.Bucket, tk *pb.Token) error {
+	raw, err := proto.Marshal(tk)
+	if err != nil {
+		return fmt.Errorf("proto marshal: %w", err)
+	}
+
+	return b.Put([]byte(tk.Name), raw)
+}
+
+// CreateToken creates a new token with the given name and returns its secret.
+// The secret itself is never stored, only its hash is. If ttl is nil the token
+// never expires.
+func (cdb *CapybaraDB) CreateToken(name string, ttl *time.Duration, admin bool, scopes []string) (string, *pb.Token, error) {
+	secret, err := cmd.GenerateToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	tk := &pb.Token{
+		Name:      name,
+		Hash:      cmd.HashToken(secret),
+		CreatedAt: timestamppb.Now(),
+		Admin:     admin,
+		Scopes:    scopes,
+	}
+	if ttl != nil {
+		tk.ExpiresAt = timestamppb.New(time.Now().Add(*ttl))
+	}
+
+	err = cdb.db.Update(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(TokensBucket))
+		if b == nil {
+			return ErrTokensBucketNotFound
+		}
+
+		if b.Get([]byte(name)) != nil {
+			return ErrTokenExists
+		}
+
+		return putToken(b, tk)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return secret, tk, nil
+}
+
+// RevokeToken revokes the token with the given name. Revoked tokens are kept
+// in the database so they can still be listed.
+func (cdb *CapybaraDB) RevokeToken(name string) error {
+	return cdb.db.Update(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(TokensBucket))
+		if b == nil {
+			return ErrTokensBucketNotFound
+		}
+
+		raw := b.Get([]byte(name))
+		if raw == nil {
+			return ErrTokenNotFound
+		}
+
+		tk := &pb.Token{}
+		if err := proto.Unmarshal(raw, tk); err != nil {
+			return fmt.Errorf("proto unmarshal: %w", err)
+		}
+
+		if tk.RevokedAt != nil {
+			return nil
+		}
+
+		tk.RevokedAt = timestamppb.Now()
+		return putToken(b, tk)
+	})
+}
+
+// ListTokens returns all the tokens stored in the database.
+func (cdb *CapybaraDB) ListTokens() ([]*pb.Token, error) {
+	tokens := []*pb.Token{}
+
+	err := cdb.db.View(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(TokensBucket))
+		if b == nil {
+			return ErrTokensBucketNotFound
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			tk := &pb.Token{}
+			if err := proto.Unmarshal(v, tk); err != nil {
+				return fmt.Errorf("proto unmarshal: %w", err)
+			}
+			tokens = append(tokens, tk)
+			return nil
+		})
+	})
+
+	return tokens, err
+}
+
+// Authenticate finds the token matching the given secret. An error is
+// returned if no token matches, or if the matching token is expired or
+// revoked.
+func (cdb *CapybaraDB) Authenticate(secret string) (*pb.Token, error) {
+	hash := cmd.HashToken(secret)
+
+	var found *pb.Token
+
+	err := cdb.db.View(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(TokensBucket))
+		if b == nil {
+			return ErrTokensBucketNotFound
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			tk := &pb.Token{}
+			if err := proto.Unmarshal(v, tk); err != nil {
+				return fmt.Errorf("proto unmarshal: %w", err)
+			}
+			if subtle.ConstantTimeCompare(tk.Hash, hash) == 1 {
+				found = tk
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found, checkToken(found)
+}
+
+// AuthenticateName finds the token with the given name. This is used for
+// clients that are already authenticated by other means, such as a client
+// certificate. An error is returned if the token is expired or revoked.
+func (cdb *CapybaraDB) AuthenticateName(name string) (*pb.Token, error) {
+	var found *pb.Token
+
+	err := cdb.db.View(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(TokensBucket))
+		if b == nil {
+			return ErrTokensBucketNotFound
+		}
+
+		raw := b.Get([]byte(name))
+		if raw == nil {
+			return nil
+		}
+
+		found = &pb.Token{}
+		if err := proto.Unmarshal(raw, found); err != nil {
+			return fmt.Errorf("proto unmarshal: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found, checkToken(found)
+}
+
+// checkToken returns an error if the token is nil, revoked or expired.
+func checkToken(tk *pb.Token) error {
+	if tk == nil {
+		return ErrTokenNotFound
+	}
+
+	if tk.RevokedAt != nil {
+		return ErrTokenRevoked
+	}
+
+	if tk.ExpiresAt != nil && tk.ExpiresAt.AsTime().Before(time.Now()) {
+		return ErrTokenExpired
+	}
+
+	return nil
+}
+
+// importTokens imports the tokens declared in the configuration and returns
+// the number of imported and revoked tokens. A token that already exists is
+// updated to match the configuration unless it was revoked, so a token revoked
+// at runtime stays revoked across restarts. Tokens imported from a previous
+// configuration that are no longer declared are revoked.
+func importTokens(t *bolt.Tx, tokens []cmd.TokenConf) (int, int, error) {
+	b := t.Bucket([]byte(TokensBucket))
+	if b == nil {
+		return 0, 0, ErrTokensBucketNotFound
+	}
+
+	imported, err := putConfigTokens(b, tokens)
+	if err != nil {
+		return imported, 0, err
+	}
+
+	declared := make(map[string]bool, len(tokens))
+	for _, tc := range tokens {
+		declared[tc.Name] = true
+	}
+
+	revoked, err := updateEach(b, func(_, v []byte) (*pb.Token, bool, error) {
+		tk := &pb.Token{}
+		if err := proto.Unmarshal(v, tk); err != nil {
+			return nil, false, fmt.Errorf("proto unmarshal: %w", err)
+		}
+		return tk, tk.FromConfig && tk.RevokedAt == nil && !declared[tk.Name], nil
+	}, func(_ string, tk *pb.Token) error {
+		tk.RevokedAt = timestamppb.Now()
+		return putToken(b, tk)
+	})
+	if err != nil {
+		return imported, 0, err
+	}
+
+	return imported, revoked, nil
+}
+
+// putConfigTokens stores the tokens declared in the configuration and returns
+// the number of stored tokens.
+func putConfigTokens(b *bolt.Bucket, tokens []cmd.TokenConf) (int, error) {
+	var imported int
+
+	for _, tc := range tokens {
+		if tc.Name == "" {
+			return imported, fmt.Errorf("token with hash %s: missing name", tc.Hash)
+		}
+
+		hash, err := hex.DecodeString(tc.Hash)
+		if err != nil || len(hash) != 32 {
+			return imported, fmt.Errorf("token %s: hash must be a hex encoded sha256", tc.Name)
+		}
+
+		tk := &pb.Token{Name: tc.Name, CreatedAt: timestamppb.Now()}
+		if raw := b.Get([]byte(tc.Name)); raw != nil {
+			if err := proto.Unmarshal(raw, tk); err != nil {
+				return imported, fmt.Errorf("proto unmarshal: %w", err)
+			}
+			if tk.RevokedAt != nil {
+				continue
+			}
+		}
+
+		tk.Hash = hash
+		tk.FromConfig = true
+		tk.Admin = tc.Admin
+		tk.Scopes = tc.Scopes
+		tk.ExpiresAt = nil
+		if !tc.ExpiresAt.IsZero() {
+			tk.ExpiresAt = timestamppb.New(tc.ExpiresAt)
+		}
+
+		if err := putToken(b, tk); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+
+	return imported, nil
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/depado/capybara/cmd"
+)
+
+func TestImportTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capybara.db")
+
+	// open opens the database with the given configuration tokens, the secret
+	// of each token being its name
+	open := func(names ...string) *CapybaraDB {
+		t.Helper()
+
+		conf := &cmd.Conf{Database: cmd.DatabaseConf{Path: path, DefaultLockTTL: time.Minute}}
+		for _, name := range names {
+			conf.Auth.Tokens = append(conf.Auth.Tokens, cmd.TokenConf{Name: name, Hash: hex.EncodeToString(cmd.HashToken(name))})
+		}
+
+		cdb, err := NewCapybaraDB(conf, zerolog.Nop())
+		if err != nil {
+			t.Fatalf("open database: %v", err)
+		}
+		return cdb
+	}
+
+	cdb := open("kept", "removed", "revoked")
+	secret, _, err := cdb.CreateToken("runtime", nil, false, nil)
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	if err := cdb.RevokeToken("revoked"); err != nil {
+		t.Fatalf("revoke token: %v", err)
+	}
+	if err := cdb.Close(); err != nil {
+		t.Fatalf("close database: %v", err)
+	}
+
+	cdb = open("kept", "revoked")
+	t.Cleanup(func() {
+		if err := cdb.Close(); err != nil {
+			t.Errorf("close database: %v", err)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr error
+	}{
+		{"declared token", "kept", nil},
+		{"token removed from the configuration", "removed", ErrTokenRevoked},
+		{"token revoked at runtime", "revoked", ErrTokenRevoked},
+		{"token created at runtime", secret, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := cdb.Authenticate(tt.secret); !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package database
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/depado/capybara/pb"
+)
+
+// TxnOpType is the type of an operation run by a transaction.
+type TxnOpType int
+
+const (
+	// TxnPut writes a key the way PutWithOptions does.
+	TxnPut TxnOpType = iota
+	// TxnGet reads a key the way GetEntry does, a missing key isn't an error.
+	TxnGet
+	// TxnDelete deletes a key the way DeleteWithOptions does.
+	TxnDelete
+	// TxnRange reads the keys of a bucket starting with a prefix.
+	TxnRange
+)
+
+// TxnOp is an operation run by a transaction. Key is the prefix of the keys
+// for a range, and Limit the maximum number of keys it returns. The options
+// are used by the put and delete operations.
+type TxnOp struct {
+	Type          TxnOpType
+	Buckets       []string
+	Key           string
+	Value         []byte
+	PutOptions    PutOptions
+	DeleteOptions DeleteOptions
+	Limit         int
+}
+
+// KeyEntry is a kv entry along with its key.
+type KeyEntry struct {
+	Key   string
+	Entry *pb.Entry
+}
+
+// TxnResult is the result of a transaction operation. Revision is the new
+// revision of a put key, Entry the entry read by a get, nil if the key
+// doesn't exist, and Entries the entries read by a range, More being true if
+// the limit was reached before the last key.
+type TxnResult struct {
+	Revision uint64
+	Entry    *pb.Entry
+	Entries  []KeyEntry
+	More     bool
+}
+
+// Txn compares the current entries of keys, then runs the success operations
+// if every comparison succeeded or the failure operations otherwise. The
+// comparisons and operations are all run in a single transaction: if an
+// operation fails, none of them is applied and its error is returned, naming
+// its branch and its index within that branch.
+//
+// The returned boolean is true if every comparison succeeded, and the
+// results are those of the operations that were run, in order.
+func (cdb *CapybaraDB) Txn(compares []*pb.Compare, success, failure []TxnOp) (bool, []TxnResult, error) {
+	start := time.Now()
+	defer func() {
+		cdb.log.Debug().Str("took", time.Since(start).String()).Str("action", "txn").Send()
+	}()
+
+	for i, c := range compares {
+		if err := checkBuckets(c.Buckets); err != nil {
+			return false, nil, fmt.Errorf("compare %d: %w", i, err)
+		}
+	}
+	for i, op := range success {
+		if err := checkBuckets(op.Buckets); err != nil {
+			return false, nil, fmt.Errorf("success operation %d: %w", i, err)
+		}
+	}
+	for i, op := range failure {
+		if err := checkBuckets(op.Buckets); err != nil {
+			return false, nil, fmt.Errorf("failure operation %d: %w", i, err)
+		}
+	}
+
+	var succeeded bool
+	var results []TxnResult
+
+	err := cdb.db.Update(func(t *bolt.Tx) error {
+		succeeded, results = true, nil
+
+		for i, c := range compares {
+			ok, err := compare(t, c)
+			if err != nil {
+				return fmt.Errorf("compare %d: %w", i, err)
+			}
+			if !ok {
+				succeeded = false
+				break
+			}
+		}
+
+		ops, branch := success, "success"
+		if !succeeded {
+			ops, branch = failure, "failure"
+		}
+
+		for i, op := range ops {
+			res, err := runOp(t, op)
+			if err != nil {
+				return fmt.Errorf("%s operation %d: %w", branch, i, err)
+			}
+			results = append(results, res)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	return succeeded, results, nil
+}
+
+// compare returns whether the current entry of the compared key meets the
+// comparison. A key that doesn't exist or expired has an empty value and
+// zero revisions and version.
+func compare(t *bolt.Tx, c *pb.Compare) (bool, error) {
+	var e *pb.Entry
+
+	b, err := Traverse(t, c.Buckets)
+	switch {
+	case errors.Is(err, ErrBucketNotFound):
+	case err != nil:
+		return false, err
+	default:
+		if e, err = currentEntry(b, c.Key); err != nil {
+			return false, err
+		}
+	}
+
+	var res int
+	switch target := c.Target.(type) {
+	case *pb.Compare_Value:
+		res = bytes.Compare(e.GetValue(), target.Value)
+	case *pb.Compare_Revision:
+		res = cmp.Compare(e.GetModRevision(), target.Revision)
+	case *pb.Compare_CreateRevision:
+		res = cmp.Compare(e.GetCreateRevision(), target.CreateRevision)
+	case *pb.Compare_Version:
+		res = cmp.Compare(e.GetVersion(), target.Version)
+	default:
+		return false, errors.New("no compare target")
+	}
+
+	switch c.Result {
+	case pb.Compare_EQUAL:
+		return res == 0, nil
+	case pb.Compare_NOT_EQUAL:
+		return res != 0, nil
+	case pb.Compare_GREATER:
+		return res > 0, nil
+	case pb.Compare_LESS:
+		return res < 0, nil
+	}
+
+	return false, fmt.Errorf("unknown compare result %v", c.Result)
+}
+
+// runOp runs a transaction operation within the transaction.
+func runOp(t *bolt.Tx, op TxnOp) (TxnResult, error) {
+	var res TxnResult
+	var err error
+
+	switch op.Type {
+	case TxnPut:
+		res.Revision, err = putKey(t, op.Buckets, op.Key, op.Value, op.PutOptions)
+	case TxnGet:
+		res.Entry, err = getKey(t, op.Buckets, op.Key)
+		if errors.Is(err, ErrBucketNotFound) || errors.Is(err, ErrKeyNotFound) {
+			res.Entry, err = nil, nil
+		}
+	case TxnDelete:
+		err = deleteKey(t, op.Buckets, op.Key, op.DeleteOptions)
+	case TxnRange:
+		res.Entries, res.More, err = rangeKeys(t, op.Buckets, op.Key, op.Limit)
+	default:
+		err = fmt.Errorf("unknown operation type %d", op.Type)
+	}
+
+	return res, err
+}
+
+// rangeKeys returns up to limit entries whose key starts with prefix in the
+// given bucket path, sorted by key, and whether there are more of them.
+// Expired entries and nested buckets are skipped, and a missing bucket has no
+// entries.
+func rangeKeys(t *bolt.Tx, buckets []string, prefix string, limit int) ([]KeyEntry, bool, error) {
+	b, err := Traverse(t, buckets)
+	if errors.Is(err, ErrBucketNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var entries []KeyEntry
+
+	c := b.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+		if v == nil {
+			continue
+		}
+
+		e, err := currentEntry(b, string(k))
+		if err != nil {
+			return nil, false, fmt.Errorf("key %s: %w", k, err)
+		}
+		if e == nil {
+			continue
+		}
+
+		if len(entries) == limit {
+			return entries, true, nil
+		}
+		entries = append(entries, KeyEntry{Key: string(k), Entry: e})
+	}
+
+	return entries, false, nil
+}
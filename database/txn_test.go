@@ -0,0 +1,181 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/depado/capybara/pb"
+)
+
+func TestTxnCompare(t *testing.T) {
+	cdb := newTestDB(t)
+
+	bucket := []string{"txn"}
+	if err := cdb.Put(bucket, "key", []byte("a")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := cdb.Put(bucket, "key", []byte("b")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	e, err := cdb.GetEntry(bucket, "key")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	value := func(v string) *pb.Compare {
+		return &pb.Compare{Buckets: bucket, Key: "key", Target: &pb.Compare_Value{Value: []byte(v)}}
+	}
+	revision := func(r uint64) *pb.Compare {
+		return &pb.Compare{Buckets: bucket, Key: "key", Target: &pb.Compare_Revision{Revision: r}}
+	}
+	createRevision := func(r uint64) *pb.Compare {
+		return &pb.Compare{Buckets: bucket, Key: "key", Target: &pb.Compare_CreateRevision{CreateRevision: r}}
+	}
+	version := func(v uint64) *pb.Compare {
+		return &pb.Compare{Buckets: bucket, Key: "key", Target: &pb.Compare_Version{Version: v}}
+	}
+	missing := func(c *pb.Compare, buckets []string) *pb.Compare {
+		c.Buckets, c.Key = buckets, "missing"
+		return c
+	}
+	result := func(c *pb.Compare, r pb.Compare_Result) *pb.Compare {
+		c.Result = r
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		compares []*pb.Compare
+		want     bool
+	}{
+		{"no comparison", nil, true},
+		{"value equal", []*pb.Compare{result(value("b"), pb.Compare_EQUAL)}, true},
+		{"value not equal", []*pb.Compare{result(value("a"), pb.Compare_EQUAL)}, false},
+		{"value different", []*pb.Compare{result(value("a"), pb.Compare_NOT_EQUAL)}, true},
+		{"value greater", []*pb.Compare{result(value("a"), pb.Compare_GREATER)}, true},
+		{"value not greater", []*pb.Compare{result(value("c"), pb.Compare_GREATER)}, false},
+		{"value less", []*pb.Compare{result(value("c"), pb.Compare_LESS)}, true},
+		{"value not less", []*pb.Compare{result(value("b"), pb.Compare_LESS)}, false},
+		{"revision equal", []*pb.Compare{result(revision(e.ModRevision), pb.Compare_EQUAL)}, true},
+		{"revision not equal", []*pb.Compare{result(revision(e.CreateRevision), pb.Compare_EQUAL)}, false},
+		{"revision greater", []*pb.Compare{result(revision(e.CreateRevision), pb.Compare_GREATER)}, true},
+		{"revision less", []*pb.Compare{result(revision(e.ModRevision+1), pb.Compare_LESS)}, true},
+		{"create revision equal", []*pb.Compare{result(createRevision(e.CreateRevision), pb.Compare_EQUAL)}, true},
+		{"create revision not equal", []*pb.Compare{result(createRevision(e.ModRevision), pb.Compare_NOT_EQUAL)}, true},
+		{"create revision not greater", []*pb.Compare{result(createRevision(e.CreateRevision), pb.Compare_GREATER)}, false},
+		{"version equal", []*pb.Compare{result(version(2), pb.Compare_EQUAL)}, true},
+		{"version greater", []*pb.Compare{result(version(1), pb.Compare_GREATER)}, true},
+		{"version not less", []*pb.Compare{result(version(2), pb.Compare_LESS)}, false},
+		{"missing key has an empty value", []*pb.Compare{result(missing(value(""), bucket), pb.Compare_EQUAL)}, true},
+		{"missing key has zero revision", []*pb.Compare{result(missing(revision(0), bucket), pb.Compare_EQUAL)}, true},
+		{"missing key has zero create revision", []*pb.Compare{result(missing(createRevision(0), bucket), pb.Compare_EQUAL)}, true},
+		{"missing key has zero version", []*pb.Compare{result(missing(version(0), bucket), pb.Compare_EQUAL)}, true},
+		{"missing bucket is like a missing key", []*pb.Compare{result(missing(version(0), []string{"nope"}), pb.Compare_EQUAL)}, true},
+		{
+			name: "every comparison must succeed",
+			compares: []*pb.Compare{
+				result(value("b"), pb.Compare_EQUAL),
+				result(version(1), pb.Compare_EQUAL),
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The branches have a different number of operations to tell
+			// which one was run
+			success := []TxnOp{{Type: TxnGet, Buckets: bucket, Key: "key"}}
+			failure := []TxnOp{{Type: TxnGet, Buckets: bucket, Key: "key"}, {Type: TxnGet, Buckets: bucket, Key: "missing"}}
+
+			succeeded, results, err := cdb.Txn(tt.compares, success, failure)
+			if err != nil {
+				t.Fatalf("txn: %v", err)
+			}
+
+			if succeeded != tt.want {
+				t.Errorf("expected succeeded %t, got %t", tt.want, succeeded)
+			}
+
+			ops := success
+			if !tt.want {
+				ops = failure
+			}
+			if len(results) != len(ops) {
+				t.Fatalf("expected %d results, got %d", len(ops), len(results))
+			}
+			if string(results[0].Entry.GetValue()) != "b" {
+				t.Errorf("expected to read b, got %q", results[0].Entry.GetValue())
+			}
+		})
+	}
+}
+
+func TestTxnErrors(t *testing.T) {
+	cdb := newTestDB(t)
+
+	bucket := []string{"txn"}
+	if err := cdb.Put(bucket, "key", []byte("a")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	fails := &pb.Compare{Buckets: bucket, Key: "key", Target: &pb.Compare_Value{Value: []byte("b")}}
+	put := TxnOp{Type: TxnPut, Buckets: bucket, Key: "other", Value: []byte("v")}
+	conflict := TxnOp{Type: TxnPut, Buckets: bucket, Key: "key", Value: []byte("v"), PutOptions: PutOptions{IfAbsent: true}}
+	internal := TxnOp{Type: TxnGet, Buckets: []string{LocksBucket}, Key: "key"}
+
+	tests := []struct {
+		name     string
+		compares []*pb.Compare
+		success  []TxnOp
+		failure  []TxnOp
+		wantErr  error
+		wantMsg  string
+	}{
+		{
+			name:    "invalid success operation",
+			success: []TxnOp{put, internal},
+			wantErr: ErrInternalBucket,
+			wantMsg: "success operation 1",
+		},
+		{
+			name:    "invalid failure operation",
+			success: []TxnOp{put, put},
+			failure: []TxnOp{internal},
+			wantErr: ErrInternalBucket,
+			wantMsg: "failure operation 0",
+		},
+		{
+			name:    "failed success operation",
+			success: []TxnOp{put, conflict},
+			wantErr: ErrConditionFailed,
+			wantMsg: "success operation 1",
+		},
+		{
+			name:     "failed failure operation",
+			compares: []*pb.Compare{fails},
+			success:  []TxnOp{put},
+			failure:  []TxnOp{put, put, conflict},
+			wantErr:  ErrConditionFailed,
+			wantMsg:  "failure operation 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := cdb.Txn(tt.compares, tt.success, tt.failure)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("expected error to mention %q, got %v", tt.wantMsg, err)
+			}
+
+			// None of the operations was applied
+			if _, err := cdb.GetEntry(bucket, "other"); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("expected other to not be written, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/depado/capybara/pb"
+)
+
+// waiter is a client waiting for a lock. Its channel is signaled whenever it
+// should check the lock again.
+type waiter struct {
+	ch     chan struct{}
+	shared bool
+}
+
+// enqueue adds a new waiter at the end of the lock's queue.
+func (cdb *CapybaraDB) enqueue(key string, shared bool) *waiter {
+	cdb.waitm.Lock()
+	defer cdb.waitm.Unlock()
+
+	w := &waiter{ch: make(chan struct{}, 1), shared: shared}
+	cdb.waiters[key] = append(cdb.waiters[key], w)
+
+	return w
+}
+
+// dequeue removes the waiter from the lock's queue, and wakes the next waiter
+// up if the removed one was first in line.
+func (cdb *CapybaraDB) dequeue(key string, w *waiter) {
+	cdb.waitm.Lock()
+	defer cdb.waitm.Unlock()
+
+	q := cdb.waiters[key]
+	i := slices.Index(q, w)
+	if i < 0 {
+		return
+	}
+
+	q = slices.Delete(q, i, i+1)
+	if len(q) == 0 {
+		delete(cdb.waiters, key)
+		return
+	}
+
+	cdb.waiters[key] = q
+	if i == 0 {
+		signal(q[0])
+	}
+}
+
+// isHead returns whether the waiter is first in line for the lock.
+func (cdb *CapybaraDB) isHead(key string, w *waiter) bool {
+	cdb.waitm.Lock()
+	defer cdb.waitm.Unlock()
+
+	q := cdb.waiters[key]
+	return len(q) > 0 && q[0] == w
+}
+
+// waiting returns whether clients are waiting for the lock.
+func (cdb *CapybaraDB) waiting(key string) bool {
+	cdb.waitm.Lock()
+	defer cdb.waitm.Unlock()
+
+	return len(cdb.waiters[key]) > 0
+}
+
+// exclusiveWaiting returns whether a client is waiting for the exclusive lock.
+func (cdb *CapybaraDB) exclusiveWaiting(key string) bool {
+	cdb.waitm.Lock()
+	defer cdb.waitm.Unlock()
+
+	return slices.ContainsFunc(cdb.waiters[key], func(w *waiter) bool { return !w.shared })
+}
+
+// notifyWaiters wakes up the waiter first in line for the lock, if any.
+func (cdb *CapybaraDB) notifyWaiters(key string) {
+	cdb.waitm.Lock()
+	defer cdb.waitm.Unlock()
+
+	if q := cdb.waiters[key]; len(q) > 0 {
+		signal(q[0])
+	}
+}
+
+// signal wakes the waiter up without blocking. The channel being buffered, a
+// signal sent while the waiter isn't listening isn't lost.
+func signal(w *waiter) {
+	select {
+	case w.ch <- struct{}{}:
+	default:
+	}
+}
+
+// WaitLock claims the lock, waiting for it to be released or to expire if it
+// is owned by someone else. Waiters are served in the order they arrived,
+// consecutive shared waiters acquiring the lock together. If the context is
+// done before the lock could be claimed, the context's error is returned.
+func (cdb *CapybaraDB) WaitLock(ctx context.Context, key, owner string, opts ClaimOptions) (*pb.Lock, bool, error) {
+	w := cdb.enqueue(key, opts.Shared)
+	defer cdb.dequeue(key, w)
+
+	for {
+		// Only the first waiter in line attempts to claim the lock
+		if !cdb.isHead(key, w) {
+			select {
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			case <-w.ch:
+				continue
+			}
+		}
+
+		lock, acquired, err := cdb.claimLock(key, owner, opts, true)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if acquired || heldBy(lock, owner, opts.Shared) {
+			return lock, acquired, nil
+		}
+
+		// Wait for the lock to be released or for a holder to expire
+		t := time.NewTimer(time.Until(nextExpiry(lock)))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return lock, false, ctx.Err()
+		case <-w.ch:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// queued returns the number of clients waiting for the lock.
+func (cdb *CapybaraDB) queued(key string) int {
+	cdb.waitm.Lock()
+	defer cdb.waitm.Unlock()
+
+	return len(cdb.waiters[key])
+}
+
+func TestWaitLockOrder(t *testing.T) {
+	type waiter struct {
+		owner  string
+		shared bool
+	}
+
+	tests := []struct {
+		name    string
+		waiters []waiter
+		// The owners acquiring the lock together, group after group
+		groups [][]string
+	}{
+		{
+			name:    "exclusive waiters are served in arrival order",
+			waiters: []waiter{{"a", false}, {"b", false}, {"c", false}},
+			groups:  [][]string{{"a"}, {"b"}, {"c"}},
+		},
+		{
+			name:    "consecutive shared waiters acquire together",
+			waiters: []waiter{{"a", true}, {"b", true}, {"c", false}, {"d", true}},
+			groups:  [][]string{{"a", "b"}, {"c"}, {"d"}},
+		},
+		{
+			name:    "shared waiters don't overtake an exclusive waiter",
+			waiters: []waiter{{"a", false}, {"b", true}, {"c", false}, {"d", true}, {"e", true}},
+			groups:  [][]string{{"a"}, {"b"}, {"c"}, {"d", "e"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cdb := newTestDB(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			const key = "queue"
+			if _, acquired, err := cdb.ClaimLock(key, "holder", ClaimOptions{}); err != nil || !acquired {
+				t.Fatalf("claim lock: acquired %t, %v", acquired, err)
+			}
+
+			acquired := make(chan string, len(tt.waiters))
+			for i, w := range tt.waiters {
+				go func() {
+					_, _, err := cdb.WaitLock(ctx, key, w.owner, ClaimOptions{Shared: w.shared})
+					if err != nil {
+						t.Errorf("wait lock %s: %v", w.owner, err)
+						return
+					}
+					acquired <- w.owner
+				}()
+
+				// Enqueue the waiters one after the other
+				for cdb.queued(key) != i+1 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+
+			if err := cdb.ReleaseLock(key, "holder"); err != nil {
+				t.Fatalf("release lock: %v", err)
+			}
+
+			for _, group := range tt.groups {
+				var got []string
+				for range group {
+					select {
+					case owner := <-acquired:
+						got = append(got, owner)
+					case <-ctx.Done():
+						t.Fatalf("waiting for %v, got %v", group, got)
+					}
+				}
+
+				// Nobody else acquires the lock while the group holds it
+				select {
+				case owner := <-acquired:
+					t.Fatalf("%s acquired the lock held by %v", owner, got)
+				case <-time.After(50 * time.Millisecond):
+				}
+
+				slices.Sort(got)
+				if !slices.Equal(got, group) {
+					t.Fatalf("expected %v to acquire the lock, got %v", group, got)
+				}
+
+				for _, owner := range group {
+					if err := cdb.ReleaseLock(key, owner); err != nil {
+						t.Fatalf("release lock %s: %v", owner, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestClaimLockDoesntBarge(t *testing.T) {
+	cdb := newTestDB(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const key = "queue"
+	if _, acquired, err := cdb.ClaimLock(key, "holder", ClaimOptions{}); err != nil || !acquired {
+		t.Fatalf("claim lock: acquired %t, %v", acquired, err)
+	}
+
+	waited := make(chan error, 1)
+	go func() {
+		_, ok, err := cdb.WaitLock(ctx, key, "waiter", ClaimOptions{})
+		if err == nil && !ok {
+			err = errors.New("lock not acquired")
+		}
+		waited <- err
+	}()
+	for cdb.queued(key) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := cdb.ReleaseLock(key, "holder"); err != nil {
+		t.Fatalf("release lock: %v", err)
+	}
+
+	// The lock is either free with the waiter queued, or held by the waiter
+	if _, ok, err := cdb.ClaimLock(key, "barger", ClaimOptions{}); err != nil || ok {
+		t.Fatalf("expected the claim to be refused, got acquired %t, %v", ok, err)
+	}
+
+	if err := <-waited; err != nil {
+		t.Fatalf("wait lock: %v", err)
+	}
+
+	// Once nobody waits, the lock can be claimed again
+	if err := cdb.ReleaseLock(key, "waiter"); err != nil {
+		t.Fatalf("release lock: %v", err)
+	}
+	if _, ok, err := cdb.ClaimLock(key, "barger", ClaimOptions{}); err != nil || !ok {
+		t.Fatalf("expected the claim to succeed, got acquired %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/depado/capybara/pb"
+)
+
+// watchBuffer is the number of events buffered for each watcher. A watcher
+// that falls further behind is disconnected.
+const watchBuffer = 128
+
+// watcher receives the events of a lock key or of every key starting with a
+// prefix.
+type watcher struct {
+	key    string
+	prefix bool
+	ch     chan *pb.LockEvent
+}
+
+// matches returns whether the watcher is interested in the given key.
+func (w *watcher) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+
+	return w.key == key
+}
+
+// WatchLocks returns a channel receiving the events of the given lock key, or
+// of every lock key starting with key if prefix is true. If current is true,
+// the channel first receives a CURRENT event with the state of the lock (whose
+// holders are empty if it isn't held), or of every held lock starting with
+// key, before any change. The returned function must be called to stop
+// watching. The channel is closed if the watcher doesn't consume the events
+// fast enough.
+func (cdb *CapybaraDB) WatchLocks(key string, prefix, current bool) (<-chan *pb.LockEvent, func(), error) {
+	// Locks can't be modified while the snapshot is taken and the watcher is
+	// registered, so that no event is missed in between
+	cdb.locksm.RLock()
+	defer cdb.locksm.RUnlock()
+
+	var snapshot []*pb.LockEvent
+	if current {
+		var err error
+		if snapshot, err = cdb.snapshotLocks(key, prefix); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	w := &watcher{key: key, prefix: prefix, ch: make(chan *pb.LockEvent, watchBuffer+len(snapshot))}
+	for _, ev := range snapshot {
+		w.ch <- ev
+	}
+
+	cdb.watchm.Lock()
+	cdb.watchers[w] = struct{}{}
+	cdb.watchm.Unlock()
+
+	return w.ch, func() {
+		cdb.watchm.Lock()
+		defer cdb.watchm.Unlock()
+
+		if _, ok := cdb.watchers[w]; ok {
+			delete(cdb.watchers, w)
+			close(w.ch)
+		}
+	}, nil
+}
+
+// snapshotLocks returns a CURRENT event for the lock, or for every held lock
+// starting with key if prefix is true. Expired holders are left out.
+func (cdb *CapybaraDB) snapshotLocks(key string, prefix bool) ([]*pb.LockEvent, error) {
+	var events []*pb.LockEvent
+
+	err := cdb.db.View(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(LocksBucket))
+		if b == nil {
+			return ErrLocksBucketNotFound
+		}
+
+		now := time.Now()
+		if !prefix {
+			lock, err := loadLock(b, key)
+			if err != nil {
+				return err
+			}
+			expireHolders(&lock.Holders, now)
+			events = append(events, newEvent(pb.LockEvent_CURRENT, key, lock, nil))
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte(key)); k != nil && bytes.HasPrefix(k, []byte(key)); k, _ = c.Next() {
+			lock, err := loadLock(b, string(k))
+			if err != nil {
+				return fmt.Errorf("lock %s: %w", k, err)
+			}
+			if expireHolders(&lock.Holders, now); len(lock.Holders) > 0 {
+				events = append(events, newEvent(pb.LockEvent_CURRENT, string(k), lock, nil))
+			}
+		}
+		return nil
+	})
+
+	return events, err
+}
+
+// newEvent creates a lock event about the given holder, if any. The lock and
+// holder are cloned so the event isn't affected by later modifications.
+func newEvent(typ pb.LockEvent_Type, key string, lock *pb.Lock, h *pb.Holder) *pb.LockEvent {
+	l := cloneLock(lock)
+	summarize(l)
+
+	ev := &pb.LockEvent{Type: typ, Key: key, Lock: l}
+	if h != nil {
+		ev.Holder = proto.Clone(h).(*pb.Holder)
+	}
+
+	return ev
+}
+
+// publish sends the events to the interested watchers, and wakes up the
+// clients waiting for the locks that were released or expired. It must be
+// called once the transaction that generated the events is committed.
+func (cdb *CapybaraDB) publish(events ...*pb.LockEvent) {
+	cdb.watchm.Lock()
+	for _, ev := range events {
+		for w := range cdb.watchers {
+			if !w.matches(ev.Key) {
+				continue
+			}
+			select {
+			case w.ch <- ev:
+			default:
+				cdb.log.Warn().Str("key", w.key).Bool("prefix", w.prefix).Msg("lock watcher is too slow, disconnecting")
+				delete(cdb.watchers, w)
+				close(w.ch)
+			}
+		}
+	}
+	cdb.watchm.Unlock()
+
+	for _, ev := range events {
+		if ev.Type == pb.LockEvent_RELEASED || ev.Type == pb.LockEvent_EXPIRED {
+			cdb.notifyWaiters(ev.Key)
+		}
+	}
+}
@@ -27,22 +27,23 @@ func run() {
 		lg.Fatal().Err(err).Msg("unable to initialize database")
 	}
 
+	gs, err := server.NewGRPCServer(conf, lg, cdb)
+	if err != nil {
+		lg.Fatal().Err(err).Msg("unable to initialize grpc server")
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		err := cdb.Close()
-		if err != nil {
-			lg.Error().Err(err).Msg("closing database")
-		}
-		os.Exit(1)
+		gs.Stop()
 	}()
 
-	gs, err := server.NewGRPCServer(conf, lg, cdb)
-	if err != nil {
-		lg.Fatal().Err(err).Msg("unable to initialize grpc server")
-	}
 	server.Listen(conf, lg, gs)
+
+	if err := cdb.Close(); err != nil {
+		lg.Error().Err(err).Msg("closing database")
+	}
 }
 
 // Main command that will be run when no other command is provided on the
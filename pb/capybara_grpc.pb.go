@@ -24,12 +24,43 @@ const _ = grpc.SupportPackageIsVersion7
 type CapybaraClient interface {
 	// Acquires a lock
 	ClaimLock(ctx context.Context, in *LockRequest, opts ...grpc.CallOption) (*LockResponse, error)
+	// Acquires a lock, waiting for it to be released or to expire if needed
+	WaitLock(ctx context.Context, in *LockRequest, opts ...grpc.CallOption) (*LockResponse, error)
+	// Extends a lock owned by the caller, without ever acquiring it
+	RefreshLock(ctx context.Context, in *LockRequest, opts ...grpc.CallOption) (*LockResponse, error)
 	// Release a lock
 	ReleaseLock(ctx context.Context, in *ReleaseRequest, opts ...grpc.CallOption) (*ReleaseResponse, error)
+	// Release a lock held by anyone, requires an admin token or scope
+	ForceReleaseLock(ctx context.Context, in *ForceReleaseRequest, opts ...grpc.CallOption) (*ForceReleaseResponse, error)
+	// Acquires several locks atomically, either all of them or none
+	ClaimLocks(ctx context.Context, in *LocksRequest, opts ...grpc.CallOption) (*LocksResponse, error)
+	// Release several locks at once
+	ReleaseLocks(ctx context.Context, in *ReleaseLocksRequest, opts ...grpc.CallOption) (*ReleaseResponse, error)
+	// Stream the events of a lock or of the locks starting with a prefix
+	WatchLocks(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Capybara_WatchLocksClient, error)
+	// Inspect the locks without claiming them
+	GetLock(ctx context.Context, in *GetLockRequest, opts ...grpc.CallOption) (*LockInfo, error)
+	ListLocks(ctx context.Context, in *ListLocksRequest, opts ...grpc.CallOption) (*ListLocksResponse, error)
+	// Create a session, locks and kv entries can be attached to
+	CreateSession(ctx context.Context, in *CreateSessionRequest, opts ...grpc.CallOption) (*Session, error)
+	// Extend a session along with every lock attached to it
+	KeepAliveSession(ctx context.Context, in *SessionRequest, opts ...grpc.CallOption) (*Session, error)
+	// Close a session, releasing its locks and deleting its kv entries
+	CloseSession(ctx context.Context, in *SessionRequest, opts ...grpc.CallOption) (*CloseSessionResponse, error)
+	// Acquires one of the permits of a semaphore
+	AcquireSemaphore(ctx context.Context, in *SemaphoreRequest, opts ...grpc.CallOption) (*SemaphoreResponse, error)
+	// Release a semaphore permit
+	ReleaseSemaphore(ctx context.Context, in *ReleaseRequest, opts ...grpc.CallOption) (*ReleaseResponse, error)
 	// CRUD operations
 	Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error)
 	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
 	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// Run kv operations atomically depending on comparisons
+	Txn(ctx context.Context, in *TxnRequest, opts ...grpc.CallOption) (*TxnResponse, error)
+	// Token management, requires an admin token
+	CreateToken(ctx context.Context, in *CreateTokenRequest, opts ...grpc.CallOption) (*CreateTokenResponse, error)
+	RevokeToken(ctx context.Context, in *RevokeTokenRequest, opts ...grpc.CallOption) (*RevokeTokenResponse, error)
+	ListTokens(ctx context.Context, in *ListTokensRequest, opts ...grpc.CallOption) (*ListTokensResponse, error)
 }
 
 type capybaraClient struct {
@@ -49,6 +80,24 @@ func (c *capybaraClient) ClaimLock(ctx context.Context, in *LockRequest, opts ..
 	return out, nil
 }
 
+func (c *capybaraClient) WaitLock(ctx context.Context, in *LockRequest, opts ...grpc.CallOption) (*LockResponse, error) {
+	out := new(LockResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/WaitLock", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) RefreshLock(ctx context.Context, in *LockRequest, opts ...grpc.CallOption) (*LockResponse, error) {
+	out := new(LockResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/RefreshLock", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *capybaraClient) ReleaseLock(ctx context.Context, in *ReleaseRequest, opts ...grpc.CallOption) (*ReleaseResponse, error) {
 	out := new(ReleaseResponse)
 	err := c.cc.Invoke(ctx, "/pb.Capybara/ReleaseLock", in, out, opts...)
@@ -58,6 +107,128 @@ func (c *capybaraClient) ReleaseLock(ctx context.Context, in *ReleaseRequest, op
 	return out, nil
 }
 
+func (c *capybaraClient) ForceReleaseLock(ctx context.Context, in *ForceReleaseRequest, opts ...grpc.CallOption) (*ForceReleaseResponse, error) {
+	out := new(ForceReleaseResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/ForceReleaseLock", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) ClaimLocks(ctx context.Context, in *LocksRequest, opts ...grpc.CallOption) (*LocksResponse, error) {
+	out := new(LocksResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/ClaimLocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) ReleaseLocks(ctx context.Context, in *ReleaseLocksRequest, opts ...grpc.CallOption) (*ReleaseResponse, error) {
+	out := new(ReleaseResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/ReleaseLocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) WatchLocks(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Capybara_WatchLocksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Capybara_ServiceDesc.Streams[0], "/pb.Capybara/WatchLocks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &capybaraWatchLocksClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Capybara_WatchLocksClient interface {
+	Recv() (*LockEvent, error)
+	grpc.ClientStream
+}
+
+type capybaraWatchLocksClient struct {
+	grpc.ClientStream
+}
+
+func (x *capybaraWatchLocksClient) Recv() (*LockEvent, error) {
+	m := new(LockEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *capybaraClient) GetLock(ctx context.Context, in *GetLockRequest, opts ...grpc.CallOption) (*LockInfo, error) {
+	out := new(LockInfo)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/GetLock", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) ListLocks(ctx context.Context, in *ListLocksRequest, opts ...grpc.CallOption) (*ListLocksResponse, error) {
+	out := new(ListLocksResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/ListLocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) CreateSession(ctx context.Context, in *CreateSessionRequest, opts ...grpc.CallOption) (*Session, error) {
+	out := new(Session)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/CreateSession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) KeepAliveSession(ctx context.Context, in *SessionRequest, opts ...grpc.CallOption) (*Session, error) {
+	out := new(Session)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/KeepAliveSession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) CloseSession(ctx context.Context, in *SessionRequest, opts ...grpc.CallOption) (*CloseSessionResponse, error) {
+	out := new(CloseSessionResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/CloseSession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) AcquireSemaphore(ctx context.Context, in *SemaphoreRequest, opts ...grpc.CallOption) (*SemaphoreResponse, error) {
+	out := new(SemaphoreResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/AcquireSemaphore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) ReleaseSemaphore(ctx context.Context, in *ReleaseRequest, opts ...grpc.CallOption) (*ReleaseResponse, error) {
+	out := new(ReleaseResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/ReleaseSemaphore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *capybaraClient) Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error) {
 	out := new(PutResponse)
 	err := c.cc.Invoke(ctx, "/pb.Capybara/Put", in, out, opts...)
@@ -85,18 +256,85 @@ func (c *capybaraClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.C
 	return out, nil
 }
 
+func (c *capybaraClient) Txn(ctx context.Context, in *TxnRequest, opts ...grpc.CallOption) (*TxnResponse, error) {
+	out := new(TxnResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/Txn", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) CreateToken(ctx context.Context, in *CreateTokenRequest, opts ...grpc.CallOption) (*CreateTokenResponse, error) {
+	out := new(CreateTokenResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/CreateToken", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) RevokeToken(ctx context.Context, in *RevokeTokenRequest, opts ...grpc.CallOption) (*RevokeTokenResponse, error) {
+	out := new(RevokeTokenResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/RevokeToken", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *capybaraClient) ListTokens(ctx context.Context, in *ListTokensRequest, opts ...grpc.CallOption) (*ListTokensResponse, error) {
+	out := new(ListTokensResponse)
+	err := c.cc.Invoke(ctx, "/pb.Capybara/ListTokens", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // CapybaraServer is the server API for Capybara service.
 // All implementations must embed UnimplementedCapybaraServer
 // for forward compatibility
 type CapybaraServer interface {
 	// Acquires a lock
 	ClaimLock(context.Context, *LockRequest) (*LockResponse, error)
+	// Acquires a lock, waiting for it to be released or to expire if needed
+	WaitLock(context.Context, *LockRequest) (*LockResponse, error)
+	// Extends a lock owned by the caller, without ever acquiring it
+	RefreshLock(context.Context, *LockRequest) (*LockResponse, error)
 	// Release a lock
 	ReleaseLock(context.Context, *ReleaseRequest) (*ReleaseResponse, error)
+	// Release a lock held by anyone, requires an admin token or scope
+	ForceReleaseLock(context.Context, *ForceReleaseRequest) (*ForceReleaseResponse, error)
+	// Acquires several locks atomically, either all of them or none
+	ClaimLocks(context.Context, *LocksRequest) (*LocksResponse, error)
+	// Release several locks at once
+	ReleaseLocks(context.Context, *ReleaseLocksRequest) (*ReleaseResponse, error)
+	// Stream the events of a lock or of the locks starting with a prefix
+	WatchLocks(*WatchRequest, Capybara_WatchLocksServer) error
+	// Inspect the locks without claiming them
+	GetLock(context.Context, *GetLockRequest) (*LockInfo, error)
+	ListLocks(context.Context, *ListLocksRequest) (*ListLocksResponse, error)
+	// Create a session, locks and kv entries can be attached to
+	CreateSession(context.Context, *CreateSessionRequest) (*Session, error)
+	// Extend a session along with every lock attached to it
+	KeepAliveSession(context.Context, *SessionRequest) (*Session, error)
+	// Close a session, releasing its locks and deleting its kv entries
+	CloseSession(context.Context, *SessionRequest) (*CloseSessionResponse, error)
+	// Acquires one of the permits of a semaphore
+	AcquireSemaphore(context.Context, *SemaphoreRequest) (*SemaphoreResponse, error)
+	// Release a semaphore permit
+	ReleaseSemaphore(context.Context, *ReleaseRequest) (*ReleaseResponse, error)
 	// CRUD operations
 	Put(context.Context, *PutRequest) (*PutResponse, error)
 	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
 	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// Run kv operations atomically depending on comparisons
+	Txn(context.Context, *TxnRequest) (*TxnResponse, error)
+	// Token management, requires an admin token
+	CreateToken(context.Context, *CreateTokenRequest) (*CreateTokenResponse, error)
+	RevokeToken(context.Context, *RevokeTokenRequest) (*RevokeTokenResponse, error)
+	ListTokens(context.Context, *ListTokensRequest) (*ListTokensResponse, error)
 	mustEmbedUnimplementedCapybaraServer()
 }
 
@@ -107,9 +345,48 @@ type UnimplementedCapybaraServer struct {
 func (UnimplementedCapybaraServer) ClaimLock(context.Context, *LockRequest) (*LockResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ClaimLock not implemented")
 }
+func (UnimplementedCapybaraServer) WaitLock(context.Context, *LockRequest) (*LockResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method WaitLock not implemented")
+}
+func (UnimplementedCapybaraServer) RefreshLock(context.Context, *LockRequest) (*LockResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RefreshLock not implemented")
+}
 func (UnimplementedCapybaraServer) ReleaseLock(context.Context, *ReleaseRequest) (*ReleaseResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ReleaseLock not implemented")
 }
+func (UnimplementedCapybaraServer) ForceReleaseLock(context.Context, *ForceReleaseRequest) (*ForceReleaseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ForceReleaseLock not implemented")
+}
+func (UnimplementedCapybaraServer) ClaimLocks(context.Context, *LocksRequest) (*LocksResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ClaimLocks not implemented")
+}
+func (UnimplementedCapybaraServer) ReleaseLocks(context.Context, *ReleaseLocksRequest) (*ReleaseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReleaseLocks not implemented")
+}
+func (UnimplementedCapybaraServer) WatchLocks(*WatchRequest, Capybara_WatchLocksServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchLocks not implemented")
+}
+func (UnimplementedCapybaraServer) GetLock(context.Context, *GetLockRequest) (*LockInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLock not implemented")
+}
+func (UnimplementedCapybaraServer) ListLocks(context.Context, *ListLocksRequest) (*ListLocksResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListLocks not implemented")
+}
+func (UnimplementedCapybaraServer) CreateSession(context.Context, *CreateSessionRequest) (*Session, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateSession not implemented")
+}
+func (UnimplementedCapybaraServer) KeepAliveSession(context.Context, *SessionRequest) (*Session, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method KeepAliveSession not implemented")
+}
+func (UnimplementedCapybaraServer) CloseSession(context.Context, *SessionRequest) (*CloseSessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CloseSession not implemented")
+}
+func (UnimplementedCapybaraServer) AcquireSemaphore(context.Context, *SemaphoreRequest) (*SemaphoreResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AcquireSemaphore not implemented")
+}
+func (UnimplementedCapybaraServer) ReleaseSemaphore(context.Context, *ReleaseRequest) (*ReleaseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReleaseSemaphore not implemented")
+}
 func (UnimplementedCapybaraServer) Put(context.Context, *PutRequest) (*PutResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Put not implemented")
 }
@@ -119,6 +396,18 @@ func (UnimplementedCapybaraServer) Delete(context.Context, *DeleteRequest) (*Del
 func (UnimplementedCapybaraServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
 }
+func (UnimplementedCapybaraServer) Txn(context.Context, *TxnRequest) (*TxnResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Txn not implemented")
+}
+func (UnimplementedCapybaraServer) CreateToken(context.Context, *CreateTokenRequest) (*CreateTokenResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateToken not implemented")
+}
+func (UnimplementedCapybaraServer) RevokeToken(context.Context, *RevokeTokenRequest) (*RevokeTokenResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeToken not implemented")
+}
+func (UnimplementedCapybaraServer) ListTokens(context.Context, *ListTokensRequest) (*ListTokensResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListTokens not implemented")
+}
 func (UnimplementedCapybaraServer) mustEmbedUnimplementedCapybaraServer() {}
 
 // UnsafeCapybaraServer may be embedded to opt out of forward compatibility for this service.
@@ -150,6 +439,42 @@ func _Capybara_ClaimLock_Handler(srv interface{}, ctx context.Context, dec func(
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Capybara_WaitLock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).WaitLock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/WaitLock",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).WaitLock(ctx, req.(*LockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_RefreshLock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).RefreshLock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/RefreshLock",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).RefreshLock(ctx, req.(*LockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Capybara_ReleaseLock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(ReleaseRequest)
 	if err := dec(in); err != nil {
@@ -168,6 +493,207 @@ func _Capybara_ReleaseLock_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Capybara_ForceReleaseLock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ForceReleaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).ForceReleaseLock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/ForceReleaseLock",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).ForceReleaseLock(ctx, req.(*ForceReleaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_ClaimLocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LocksRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).ClaimLocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/ClaimLocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).ClaimLocks(ctx, req.(*LocksRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_ReleaseLocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReleaseLocksRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).ReleaseLocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/ReleaseLocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).ReleaseLocks(ctx, req.(*ReleaseLocksRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_WatchLocks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CapybaraServer).WatchLocks(m, &capybaraWatchLocksServer{stream})
+}
+
+type Capybara_WatchLocksServer interface {
+	Send(*LockEvent) error
+	grpc.ServerStream
+}
+
+type capybaraWatchLocksServer struct {
+	grpc.ServerStream
+}
+
+func (x *capybaraWatchLocksServer) Send(m *LockEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Capybara_GetLock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetLockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).GetLock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/GetLock",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).GetLock(ctx, req.(*GetLockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_ListLocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListLocksRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).ListLocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/ListLocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).ListLocks(ctx, req.(*ListLocksRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_CreateSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).CreateSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/CreateSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).CreateSession(ctx, req.(*CreateSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_KeepAliveSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).KeepAliveSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/KeepAliveSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).KeepAliveSession(ctx, req.(*SessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_CloseSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).CloseSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/CloseSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).CloseSession(ctx, req.(*SessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_AcquireSemaphore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SemaphoreRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).AcquireSemaphore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/AcquireSemaphore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).AcquireSemaphore(ctx, req.(*SemaphoreRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_ReleaseSemaphore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReleaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).ReleaseSemaphore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/ReleaseSemaphore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).ReleaseSemaphore(ctx, req.(*ReleaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Capybara_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(PutRequest)
 	if err := dec(in); err != nil {
@@ -222,6 +748,78 @@ func _Capybara_Get_Handler(srv interface{}, ctx context.Context, dec func(interf
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Capybara_Txn_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TxnRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).Txn(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/Txn",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).Txn(ctx, req.(*TxnRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_CreateToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).CreateToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/CreateToken",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).CreateToken(ctx, req.(*CreateTokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_RevokeToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).RevokeToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/RevokeToken",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).RevokeToken(ctx, req.(*RevokeTokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Capybara_ListTokens_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListTokensRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CapybaraServer).ListTokens(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Capybara/ListTokens",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CapybaraServer).ListTokens(ctx, req.(*ListTokensRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Capybara_ServiceDesc is the grpc.ServiceDesc for Capybara service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -233,10 +831,58 @@ var Capybara_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ClaimLock",
 			Handler:    _Capybara_ClaimLock_Handler,
 		},
+		{
+			MethodName: "WaitLock",
+			Handler:    _Capybara_WaitLock_Handler,
+		},
+		{
+			MethodName: "RefreshLock",
+			Handler:    _Capybara_RefreshLock_Handler,
+		},
 		{
 			MethodName: "ReleaseLock",
 			Handler:    _Capybara_ReleaseLock_Handler,
 		},
+		{
+			MethodName: "ForceReleaseLock",
+			Handler:    _Capybara_ForceReleaseLock_Handler,
+		},
+		{
+			MethodName: "ClaimLocks",
+			Handler:    _Capybara_ClaimLocks_Handler,
+		},
+		{
+			MethodName: "ReleaseLocks",
+			Handler:    _Capybara_ReleaseLocks_Handler,
+		},
+		{
+			MethodName: "GetLock",
+			Handler:    _Capybara_GetLock_Handler,
+		},
+		{
+			MethodName: "ListLocks",
+			Handler:    _Capybara_ListLocks_Handler,
+		},
+		{
+			MethodName: "CreateSession",
+			Handler:    _Capybara_CreateSession_Handler,
+		},
+		{
+			MethodName: "KeepAliveSession",
+			Handler:    _Capybara_KeepAliveSession_Handler,
+		},
+		{
+			MethodName: "CloseSession",
+			Handler:    _Capybara_CloseSession_Handler,
+		},
+		{
+			MethodName: "AcquireSemaphore",
+			Handler:    _Capybara_AcquireSemaphore_Handler,
+		},
+		{
+			MethodName: "ReleaseSemaphore",
+			Handler:    _Capybara_ReleaseSemaphore_Handler,
+		},
 		{
 			MethodName: "Put",
 			Handler:    _Capybara_Put_Handler,
@@ -249,7 +895,29 @@ var Capybara_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Get",
 			Handler:    _Capybara_Get_Handler,
 		},
+		{
+			MethodName: "Txn",
+			Handler:    _Capybara_Txn_Handler,
+		},
+		{
+			MethodName: "CreateToken",
+			Handler:    _Capybara_CreateToken_Handler,
+		},
+		{
+			MethodName: "RevokeToken",
+			Handler:    _Capybara_RevokeToken_Handler,
+		},
+		{
+			MethodName: "ListTokens",
+			Handler:    _Capybara_ListTokens_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchLocks",
+			Handler:       _Capybara_WatchLocks_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "pb/capybara.proto",
 }
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Resources a scope can apply to.
+const (
+	resourceKV        = "kv"
+	resourceLock      = "lock"
+	resourceSemaphore = "semaphore"
+)
+
+// scope is a parsed token scope. Scopes are written as
+// "<resource>:<access>:<pattern>", for example "kv:r:guilds/*" grants read
+// access to every key under the guilds bucket, and "lock:rw:jobs.*" allows
+// to claim and release every lock whose key starts with "jobs.".
+//
+// The resource is either "kv", "lock" or "semaphore" and the access either
+// "r" (read only), "rw" (read and write) or "admin" (read, write and
+// administrative operations such as forcing the release of a lock). For kv
+// scopes the pattern is matched against the bucket path and key joined with
+// "/", a "/" or "%" within a bucket name or key being escaped as "%2F" or
+// "%25". A pattern ending with "*" matches every name starting with what
+// precedes it, otherwise the name must match the pattern exactly.
+type scope struct {
+	resource string
+	write    bool
+	admin    bool
+	pattern  string
+}
+
+// parseScope parses a scope string.
+func parseScope(s string) (scope, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return scope{}, fmt.Errorf("scope %q: expected <resource>:<access>:<pattern>", s)
+	}
+
+	sc := scope{resource: parts[0], pattern: parts[2]}
+
+	if sc.resource != resourceKV && sc.resource != resourceLock && sc.resource != resourceSemaphore {
+		return scope{}, fmt.Errorf("scope %q: unknown resource %q", s, sc.resource)
+	}
+
+	switch parts[1] {
+	case "r":
+	case "rw":
+		sc.write = true
+	case "admin":
+		sc.write, sc.admin = true, true
+	default:
+		return scope{}, fmt.Errorf("scope %q: unknown access %q", s, parts[1])
+	}
+
+	if sc.pattern == "" {
+		return scope{}, fmt.Errorf("scope %q: empty pattern", s)
+	}
+
+	return sc, nil
+}
+
+// validateScopes returns an error if one of the given scopes is invalid.
+func validateScopes(scopes []string) error {
+	for _, s := range scopes {
+		if _, err := parseScope(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// allows returns whether the scope grants the access to the named resource.
+func (sc scope) allows(resource string, write bool, name string) bool {
+	if sc.resource != resource || (write && !sc.write) {
+		return false
+	}
+
+	if prefix, ok := strings.CutSuffix(sc.pattern, "*"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+
+	return sc.pattern == name
+}
+
+// allowsPrefix returns whether the scope grants the access to every name
+// starting with the given prefix.
+func (sc scope) allowsPrefix(resource string, write bool, prefix string) bool {
+	if sc.resource != resource || (write && !sc.write) {
+		return false
+	}
+
+	p, ok := strings.CutSuffix(sc.pattern, "*")
+	return ok && strings.HasPrefix(prefix, p)
+}
+
+// kvEscaper escapes the separator of the names matched by kv scopes, so that
+// distinct bucket paths and keys never share a name.
+var kvEscaper = strings.NewReplacer("%", "%25", "/", "%2F")
+
+// kvName returns the name used to match kv scopes.
+func kvName(buckets []string, key string) string {
+	parts := make([]string, 0, len(buckets)+1)
+	for _, b := range buckets {
+		parts = append(parts, kvEscaper.Replace(b))
+	}
+
+	return strings.Join(append(parts, kvEscaper.Replace(key)), "/")
+}
+
+// authorize returns an error if the token the request was authenticated with
+// doesn't grant the access to the named resource. Admin tokens are granted
+// every access.
+func authorize(ctx context.Context, resource string, write bool, name string) error {
+	return authorizeFunc(ctx, resource, name, func(sc scope) bool {
+		return sc.allows(resource, write, name)
+	})
+}
+
+// authorizePrefix returns an error if the token the request was authenticated
+// with doesn't grant the access to every resource starting with prefix.
+func authorizePrefix(ctx context.Context, resource string, write bool, prefix string) error {
+	return authorizeFunc(ctx, resource, prefix+"*", func(sc scope) bool {
+		return sc.allowsPrefix(resource, write, prefix)
+	})
+}
+
+// authorizeAdmin returns an error unless the token is an admin token or one of
+// its scopes grants the admin access to the named resource.
+func authorizeAdmin(ctx context.Context, resource, name string) error {
+	return authorizeFunc(ctx, resource, name, func(sc scope) bool {
+		return sc.admin && sc.allows(resource, true, name)
+	})
+}
+
+// authorizeFunc returns an error unless the token is an admin token or one of
+// its scopes satisfies the allowed function.
+func authorizeFunc(ctx context.Context, resource, name string, allowed func(scope) bool) error {
+	tk := tokenFromContext(ctx)
+	if tk == nil {
+		return status.Errorf(codes.PermissionDenied, "no token")
+	}
+
+	if tk.Admin {
+		return nil
+	}
+
+	for _, s := range tk.Scopes {
+		sc, err := parseScope(s)
+		if err != nil {
+			continue
+		}
+		if allowed(sc) {
+			return nil
+		}
+	}
+
+	return status.Errorf(codes.PermissionDenied, "token %s isn't allowed to access %s %s", tk.Name, resource, name)
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/depado/capybara/pb"
+)
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		scope   string
+		want    scope
+		wantErr bool
+	}{
+		{scope: "kv:r:guilds/*", want: scope{resource: resourceKV, pattern: "guilds/*"}},
+		{scope: "lock:rw:jobs.*", want: scope{resource: resourceLock, write: true, pattern: "jobs.*"}},
+		{scope: "semaphore:admin:pool", want: scope{resource: resourceSemaphore, write: true, admin: true, pattern: "pool"}},
+		{scope: "kv:r:a:b", want: scope{resource: resourceKV, pattern: "a:b"}},
+		{scope: "kv:r", wantErr: true},
+		{scope: "", wantErr: true},
+		{scope: "token:r:*", wantErr: true},
+		{scope: "kv:w:*", wantErr: true},
+		{scope: "kv:RW:*", wantErr: true},
+		{scope: "kv:rw:", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			got, err := parseScope(tt.scope)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	tests := []struct {
+		name     string
+		scope    string
+		resource string
+		write    bool
+		target   string
+		want     bool
+	}{
+		{"exact match", "lock:r:jobs", resourceLock, false, "jobs", true},
+		{"exact mismatch", "lock:r:jobs", resourceLock, false, "jobs.a", false},
+		{"wildcard prefix", "lock:r:jobs.*", resourceLock, false, "jobs.a", true},
+		{"wildcard matches the prefix itself", "lock:r:jobs.*", resourceLock, false, "jobs.", true},
+		{"wildcard mismatch", "lock:r:jobs.*", resourceLock, false, "job", false},
+		{"wildcard alone", "lock:r:*", resourceLock, false, "anything", true},
+		{"other resource", "lock:rw:*", resourceKV, false, "a/b", false},
+		{"read only can't write", "kv:r:*", resourceKV, true, "a/b", false},
+		{"read write can write", "kv:rw:*", resourceKV, true, "a/b", true},
+		{"admin can write", "kv:admin:*", resourceKV, true, "a/b", true},
+		{"star isn't a wildcard within the pattern", "kv:r:a*/b", resourceKV, false, "ab/b", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := parseScope(tt.scope)
+			if err != nil {
+				t.Fatalf("parse scope: %v", err)
+			}
+			if got := sc.allows(tt.resource, tt.write, tt.target); got != tt.want {
+				t.Errorf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestScopeAllowsPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		scope  string
+		write  bool
+		prefix string
+		want   bool
+	}{
+		{"prefix within the wildcard", "kv:r:guilds/*", false, "guilds/a", true},
+		{"same prefix as the wildcard", "kv:r:guilds/*", false, "guilds/", true},
+		{"prefix wider than the wildcard", "kv:r:guilds/*", false, "guild", false},
+		{"exact pattern never allows a prefix", "kv:r:guilds/a", false, "guilds/a", false},
+		{"read only can't write", "kv:r:*", true, "a/", false},
+		{"read write can write", "kv:rw:*", true, "a/", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := parseScope(tt.scope)
+			if err != nil {
+				t.Fatalf("parse scope: %v", err)
+			}
+			if got := sc.allowsPrefix(resourceKV, tt.write, tt.prefix); got != tt.want {
+				t.Errorf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestKVName(t *testing.T) {
+	tests := []struct {
+		buckets []string
+		key     string
+		want    string
+	}{
+		{[]string{"a"}, "b", "a/b"},
+		{[]string{"a", "b"}, "c", "a/b/c"},
+		{[]string{"a/b"}, "c", "a%2Fb/c"},
+		{[]string{"a"}, "b/c", "a/b%2Fc"},
+		{[]string{"a%2Fb"}, "c", "a%252Fb/c"},
+	}
+
+	seen := make(map[string]bool)
+	for _, tt := range tests {
+		got := kvName(tt.buckets, tt.key)
+		if got != tt.want {
+			t.Errorf("%v %q: expected %q, got %q", tt.buckets, tt.key, tt.want, got)
+		}
+		if seen[got] {
+			t.Errorf("%v %q: name %q given twice", tt.buckets, tt.key, got)
+		}
+		seen[got] = true
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	scoped := &pb.Token{Name: "scoped", Scopes: []string{"kv:rw:guilds/*", "lock:admin:jobs.*", "invalid", "kv:r:configs/*"}}
+	admin := &pb.Token{Name: "admin", Admin: true}
+
+	tests := []struct {
+		name  string
+		token *pb.Token
+		check func(ctx context.Context) error
+		want  codes.Code
+	}{
+		{
+			name:  "no token",
+			check: func(ctx context.Context) error { return authorize(ctx, resourceKV, false, "guilds/a") },
+			want:  codes.PermissionDenied,
+		},
+		{
+			name:  "admin token bypasses scopes",
+			token: admin,
+			check: func(ctx context.Context) error { return authorizeAdmin(ctx, resourceLock, "anything") },
+			want:  codes.OK,
+		},
+		{
+			name:  "scope grants the access",
+			token: scoped,
+			check: func(ctx context.Context) error { return authorize(ctx, resourceKV, true, "guilds/a") },
+			want:  codes.OK,
+		},
+		{
+			name:  "invalid scopes are ignored",
+			token: scoped,
+			check: func(ctx context.Context) error { return authorize(ctx, resourceKV, false, "configs/a") },
+			want:  codes.OK,
+		},
+		{
+			name:  "read only scope",
+			token: scoped,
+			check: func(ctx context.Context) error { return authorize(ctx, resourceKV, true, "configs/a") },
+			want:  codes.PermissionDenied,
+		},
+		{
+			name:  "no matching scope",
+			token: scoped,
+			check: func(ctx context.Context) error { return authorize(ctx, resourceKV, false, "users/a") },
+			want:  codes.PermissionDenied,
+		},
+		{
+			name:  "escaped bucket doesn't match the bucket path",
+			token: scoped,
+			check: func(ctx context.Context) error {
+				return authorize(ctx, resourceKV, false, kvName([]string{"guilds/a"}, "b"))
+			},
+			want: codes.PermissionDenied,
+		},
+		{
+			name:  "prefix within the scope",
+			token: scoped,
+			check: func(ctx context.Context) error { return authorizePrefix(ctx, resourceKV, false, "guilds/a") },
+			want:  codes.OK,
+		},
+		{
+			name:  "prefix wider than the scope",
+			token: scoped,
+			check: func(ctx context.Context) error { return authorizePrefix(ctx, resourceKV, false, "guil") },
+			want:  codes.PermissionDenied,
+		},
+		{
+			name:  "admin scope",
+			token: scoped,
+			check: func(ctx context.Context) error { return authorizeAdmin(ctx, resourceLock, "jobs.a") },
+			want:  codes.OK,
+		},
+		{
+			name:  "read write scope isn't an admin scope",
+			token: scoped,
+			check: func(ctx context.Context) error { return authorizeAdmin(ctx, resourceKV, "guilds/a") },
+			want:  codes.PermissionDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.token != nil {
+				ctx = context.WithValue(ctx, tokenKey{}, tt.token)
+			}
+
+			if got := status.Code(tt.check(ctx)); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -3,30 +3,120 @@ package server
 import (
 	"context"
 
-	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+
+	"github.com/depado/capybara/pb"
 )
 
-// AuthInterceptor intercepts incoming grpc calls and will fetch the
-// authentication token in the context
-// TODO: True check.
-func (cap *CapybaraServer) AuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	meta, ok := metadata.FromIncomingContext(ctx)
+// tokenKey is the context key under which the authenticated token is stored.
+type tokenKey struct{}
+
+// tokenFromContext returns the token the request was authenticated with.
+func tokenFromContext(ctx context.Context) *pb.Token {
+	tk, _ := ctx.Value(tokenKey{}).(*pb.Token)
+	return tk
+}
+
+// peerIdentity returns the common name of the verified client certificate, if
+// the client connected using mtls. An empty string is returned otherwise.
+func peerIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
 	if !ok {
-		log.Debug().Msg("unauthenticated request")
-		return nil, status.Errorf(codes.Unauthenticated, "missing context metadata")
+		return ""
+	}
+
+	ti, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(ti.State.VerifiedChains) == 0 || len(ti.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return ti.State.VerifiedChains[0][0].Subject.CommonName
+}
+
+// authenticate fetches the token in the context metadata and checks it
+// against the tokens stored in database. If no token is provided, certificate
+// authentication is enabled and the client presented a verified certificate,
+// the token named after the certificate's common name is used instead. Admin
+// tokens can't be used that way, their secret is always required.
+func (cap *CapybaraServer) authenticate(ctx context.Context) (*pb.Token, error) {
+	meta, _ := metadata.FromIncomingContext(ctx)
+
+	if len(meta["token"]) == 0 {
+		if id := peerIdentity(ctx); cap.certAuth && id != "" {
+			tk, err := cap.db.AuthenticateName(id)
+			if err != nil {
+				cap.log.Debug().Err(err).Str("subject", id).Msg("certificate authentication failed")
+				return nil, status.Errorf(codes.Unauthenticated, "no valid token for certificate %s", id)
+			}
+			if tk.Admin {
+				cap.log.Warn().Str("subject", id).Msg("certificate authentication refused for an admin token")
+				return nil, status.Errorf(codes.Unauthenticated, "admin token %s requires its secret", id)
+			}
+			return tk, nil
+		}
+
+		cap.log.Debug().Msg("unauthenticated request")
+		return nil, status.Errorf(codes.Unauthenticated, "missing token")
 	}
 
 	if len(meta["token"]) != 1 {
 		return nil, status.Errorf(codes.Unauthenticated, "invalid token")
 	}
 
-	if meta["token"][0] != "valid-token" {
+	tk, err := cap.db.Authenticate(meta["token"][0])
+	if err != nil {
+		cap.log.Debug().Err(err).Msg("authentication failed")
 		return nil, status.Errorf(codes.Unauthenticated, "invalid token")
 	}
 
-	return handler(ctx, req)
+	return tk, nil
+}
+
+// requireAdmin returns an error if the request wasn't made with an admin
+// token.
+func requireAdmin(ctx context.Context) error {
+	if tk := tokenFromContext(ctx); tk == nil || !tk.Admin {
+		return status.Errorf(codes.PermissionDenied, "admin token required")
+	}
+
+	return nil
+}
+
+// AuthInterceptor intercepts incoming grpc calls and will fetch the
+// authentication token in the context. The token is then made available to
+// the handlers through the context.
+func (cap *CapybaraServer) AuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	tk, err := cap.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(context.WithValue(ctx, tokenKey{}, tk), req)
+}
+
+// authStream wraps a server stream to carry the authenticated token in its
+// context.
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the stream's context.
+func (s authStream) Context() context.Context {
+	return s.ctx
+}
+
+// AuthStreamInterceptor is the streaming counterpart of AuthInterceptor.
+func (cap *CapybaraServer) AuthStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	tk, err := cap.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, authStream{ServerStream: ss, ctx: context.WithValue(ss.Context(), tokenKey{}, tk)})
 }
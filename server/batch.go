@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/depado/capybara/database"
+	"github.com/depado/capybara/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxBatchLocks is the maximum number of locks claimed or released at once.
+const maxBatchLocks = 128
+
+// batchArgs validates the keys and owner of a batch of locks. When no who is
+// given, the common name of the client certificate is used.
+func batchArgs(ctx context.Context, keys []string, who string) (string, error) {
+	if len(keys) == 0 {
+		return "", status.Errorf(codes.InvalidArgument, "missing keys argument")
+	}
+	if len(keys) > maxBatchLocks {
+		return "", status.Errorf(codes.InvalidArgument, "at most %d keys can be given", maxBatchLocks)
+	}
+
+	if who == "" {
+		who = peerIdentity(ctx)
+	}
+	if who == "" {
+		return "", status.Errorf(codes.InvalidArgument, "missing who argument")
+	}
+
+	for _, k := range keys {
+		if k == "" {
+			return "", status.Errorf(codes.InvalidArgument, "empty key in keys argument")
+		}
+		if err := authorize(ctx, resourceLock, true, k); err != nil {
+			return "", err
+		}
+	}
+
+	return who, nil
+}
+
+// ClaimLocks implements the CapybaraServer interface.
+// This function claims several locks atomically: either all of them are
+// acquired, or none is. Locks already owned by the caller are refreshed like
+// ClaimLock does. If any lock is owned by another owner, the response lists
+// the locks as they were found, so the caller can tell which ones are held and
+// by whom.
+func (cap *CapybaraServer) ClaimLocks(ctx context.Context, lr *pb.LocksRequest) (*pb.LocksResponse, error) {
+	log := cap.log.With().Str("function", "ClaimLocks").Logger()
+
+	who, err := batchArgs(ctx, lr.GetKeys(), lr.GetWho())
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := cap.claimOptions(ctx, lr.TTL, lr.GetShared(), lr.GetMetadata(), lr.GetSession())
+	if err != nil {
+		return nil, err
+	}
+
+	locks, ok, err := cap.db.ClaimLocks(lr.GetKeys(), who, opts)
+	if err != nil {
+		if serr := sessionError(err); serr != nil {
+			return nil, serr
+		}
+		log.Err(err).Msg("unable to claim locks")
+		return nil, status.Errorf(codes.Internal, "an error occurred")
+	}
+
+	return &pb.LocksResponse{Acquired: ok, Locks: locks}, nil
+}
+
+// ReleaseLocks implements the CapybaraServer interface.
+// This function releases the caller's hold on several locks at once. The
+// locks owned by the caller are released even if some of the others aren't,
+// in which case NotFound or PermissionDenied is returned like ReleaseLock
+// does.
+func (cap *CapybaraServer) ReleaseLocks(ctx context.Context, rr *pb.ReleaseLocksRequest) (*pb.ReleaseResponse, error) {
+	log := cap.log.With().Str("function", "ReleaseLocks").Logger()
+
+	who, err := batchArgs(ctx, rr.GetKeys(), rr.GetWho())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cap.db.ReleaseLocks(rr.GetKeys(), who); err != nil {
+		switch {
+		case errors.Is(err, database.ErrNotOwner):
+			return nil, status.Errorf(codes.PermissionDenied, "%v", err)
+		case errors.Is(err, database.ErrLockNotFound):
+			return nil, status.Errorf(codes.NotFound, "%v", err)
+		default:
+			log.Err(err).Msg("unable to release locks")
+			return nil, status.Errorf(codes.Internal, "unable to release locks")
+		}
+	}
+
+	return &pb.ReleaseResponse{}, nil
+}
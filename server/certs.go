@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+)
+
+// reloadDelay is the time to wait after a file change before reloading, so
+// that a certificate and its key written one after the other are reloaded
+// together.
+const reloadDelay = 500 * time.Millisecond
+
+// certReloader serves the server's certificate and, in mtls mode, the CA used
+// to verify the client certificates. They are reloaded whenever one of their
+// files changes, or when the process receives SIGHUP. If the new files can't
+// be loaded, the previous certificate and CA are kept.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	caPath   string
+	log      zerolog.Logger
+	w        *fsnotify.Watcher
+
+	m    sync.RWMutex
+	cert *tls.Certificate
+	ca   []byte
+	pool *x509.CertPool
+}
+
+// newCertReloader loads the certificate and, if caPath isn't empty, the CA,
+// then starts watching for changes until the reloader is closed.
+func newCertReloader(certPath, keyPath, caPath string, log zerolog.Logger) (*certReloader, error) {
+	cr := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		caPath:   caPath,
+		log:      log.With().Str("component", "certs").Logger(),
+	}
+
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("create watcher: %w", err)
+	}
+
+	// Watch the directories rather than the files, as certificates are
+	// usually replaced by renaming a new file over the old one
+	dirs := []string{filepath.Dir(certPath), filepath.Dir(keyPath)}
+	if caPath != "" {
+		dirs = append(dirs, filepath.Dir(caPath))
+	}
+	for _, d := range dirs {
+		if err := w.Add(d); err != nil {
+			w.Close() //nolint:errcheck
+			return nil, fmt.Errorf("watch %s: %w", d, err)
+		}
+	}
+
+	cr.w = w
+	go cr.watch()
+
+	return cr, nil
+}
+
+// Close stops watching for changes.
+func (cr *certReloader) Close() error {
+	return cr.w.Close()
+}
+
+// reload loads the certificate, key and CA from disk and swaps the served
+// ones if they are all valid.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("parse certificate: %w", err)
+		}
+	}
+
+	var ca []byte
+	var pool *x509.CertPool
+	if cr.caPath != "" {
+		if ca, err = os.ReadFile(cr.caPath); err != nil {
+			return fmt.Errorf("read file: %w", err)
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("failed to add client CA's certificate")
+		}
+	}
+
+	cr.m.Lock()
+	prev, prevCA := cr.cert, cr.ca
+	cr.cert, cr.ca, cr.pool = &cert, ca, pool
+	cr.m.Unlock()
+
+	if prev == nil || !bytes.Equal(prev.Certificate[0], cert.Certificate[0]) {
+		cr.log.Info().Str("cert", cr.certPath).Str("subject", cert.Leaf.Subject.String()).
+			Time("not_after", cert.Leaf.NotAfter).Msg("loaded certificate")
+	}
+	if cr.caPath != "" && !bytes.Equal(prevCA, ca) {
+		cr.log.Info().Str("ca", cr.caPath).Msg("loaded client CA")
+	}
+
+	return nil
+}
+
+// watch reloads the certificate and CA on file changes and SIGHUP, until the
+// watcher is closed.
+func (cr *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// Stopped timer used to debounce file events
+	t := time.NewTimer(reloadDelay)
+	t.Stop()
+
+	for {
+		select {
+		case <-hup:
+			cr.log.Info().Msg("received SIGHUP, reloading certificate")
+			if err := cr.reload(); err != nil {
+				cr.log.Err(err).Msg("unable to reload certificate, keeping the previous one")
+			}
+		case ev, ok := <-cr.w.Events:
+			if !ok {
+				return
+			}
+			if ev.Has(fsnotify.Chmod) {
+				continue
+			}
+			t.Reset(reloadDelay)
+		case <-t.C:
+			if err := cr.reload(); err != nil {
+				cr.log.Err(err).Msg("unable to reload certificate, keeping the previous one")
+			}
+		case err, ok := <-cr.w.Errors:
+			if !ok {
+				return
+			}
+			cr.log.Err(err).Msg("certificate watcher error")
+		}
+	}
+}
+
+// GetCertificate returns the current certificate, it is meant to be used as
+// the tls.Config.GetCertificate callback.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.m.RLock()
+	defer cr.m.RUnlock()
+
+	return cr.cert, nil
+}
+
+// configForClient returns a tls.Config.GetConfigForClient callback, which
+// copies the base configuration to verify the client certificates against the
+// current CA.
+func (cr *certReloader) configForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cr.m.RLock()
+		defer cr.m.RUnlock()
+
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = cr.pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		return c, nil
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/depado/capybara/database"
+	"github.com/depado/capybara/pb"
+)
+
+const (
+	// defaultListLimit is the number of locks returned by ListLocks when no
+	// limit is given.
+	defaultListLimit = 100
+	// maxListLimit is the maximum number of locks returned by ListLocks.
+	maxListLimit = 1000
+)
+
+// GetLock implements the CapybaraServer interface.
+// This function returns the details of a lock without claiming it. Expired
+// holders are left out unless include_expired is set, and NotFound is
+// returned if the lock doesn't exist or all its holders expired.
+func (cap *CapybaraServer) GetLock(ctx context.Context, gr *pb.GetLockRequest) (*pb.LockInfo, error) {
+	log := cap.log.With().Str("function", "GetLock").Logger()
+
+	k := gr.GetKey()
+	if k == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing key argument")
+	}
+
+	if err := authorize(ctx, resourceLock, false, k); err != nil {
+		return nil, err
+	}
+
+	info, err := cap.db.GetLock(k, gr.GetIncludeExpired())
+	if err != nil {
+		if errors.Is(err, database.ErrLockNotFound) {
+			return nil, status.Errorf(codes.NotFound, "lock not found")
+		}
+		log.Err(err).Msg("unable to get lock")
+		return nil, status.Errorf(codes.Internal, "unable to get lock")
+	}
+
+	return info, nil
+}
+
+// ListLocks implements the CapybaraServer interface.
+// This function returns the locks whose key starts with the given prefix, in
+// key order. Results are paginated, the next_page_token of the response must
+// be given as page_token to get the next page.
+func (cap *CapybaraServer) ListLocks(ctx context.Context, lr *pb.ListLocksRequest) (*pb.ListLocksResponse, error) {
+	log := cap.log.With().Str("function", "ListLocks").Logger()
+
+	limit := int(lr.GetLimit())
+	switch {
+	case limit == 0:
+		limit = defaultListLimit
+	case limit > maxListLimit:
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be at most %d", maxListLimit)
+	}
+
+	if pt := lr.GetPageToken(); pt != "" && !strings.HasPrefix(pt, lr.GetPrefix()) {
+		return nil, status.Errorf(codes.InvalidArgument, "page token doesn't match the prefix")
+	}
+
+	if err := authorizePrefix(ctx, resourceLock, false, lr.GetPrefix()); err != nil {
+		return nil, err
+	}
+
+	infos, next, err := cap.db.ListLocks(lr.GetPrefix(), lr.GetPageToken(), limit, lr.GetIncludeExpired())
+	if err != nil {
+		log.Err(err).Msg("unable to list locks")
+		return nil, status.Errorf(codes.Internal, "unable to list locks")
+	}
+
+	return &pb.ListLocksResponse{Locks: infos, NextPageToken: next}, nil
+}
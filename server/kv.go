@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/depado/capybara/database"
 	"github.com/depado/capybara/pb"
@@ -11,69 +12,233 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-// Put will insert data in the kv store.
-func (cap *CapybaraServer) Put(ctx context.Context, pr *pb.PutRequest) (*pb.PutResponse, error) {
+// writer returns the identity of the client writing a kv entry: the name of
+// its token, or the common name of its certificate.
+func writer(ctx context.Context) string {
+	if name := tokenFromContext(ctx).GetName(); name != "" {
+		return name
+	}
+
+	return peerIdentity(ctx)
+}
+
+// fence validates the fence of a kv write, if any, and checks that the token
+// is allowed to read the lock it refers to.
+func fence(ctx context.Context, f *pb.Fence) (*database.Fence, error) {
+	if f == nil {
+		return nil, nil
+	}
+
+	if f.Lock == "" {
+		return nil, status.Error(codes.InvalidArgument, "fence lock can't be empty")
+	}
+
+	if f.Token == 0 {
+		return nil, status.Error(codes.InvalidArgument, "fence token can't be zero")
+	}
+
+	if err := authorize(ctx, resourceLock, false, f.Lock); err != nil {
+		return nil, err
+	}
+
+	return &database.Fence{Lock: f.Lock, Token: f.Token}, nil
+}
+
+// putArgs validates a put request, checks that the token is allowed to write
+// the key and returns the options of the put.
+func putArgs(ctx context.Context, pr *pb.PutRequest) (database.PutOptions, error) {
 	if len(pr.Buckets) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "at least one bucket required")
+		return database.PutOptions{}, status.Error(codes.InvalidArgument, "at least one bucket required")
 	}
 
 	if pr.Key == "" {
-		return nil, status.Error(codes.InvalidArgument, "key can't be empty")
+		return database.PutOptions{}, status.Error(codes.InvalidArgument, "key can't be empty")
 	}
 
 	if len(pr.Value) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "value is nil or empty")
+		return database.PutOptions{}, status.Error(codes.InvalidArgument, "value is nil or empty")
+	}
+
+	if pr.IfAbsent && (len(pr.IfValue) > 0 || pr.IfRevision != nil) {
+		return database.PutOptions{}, status.Error(codes.InvalidArgument, "if_absent can't be combined with another condition")
+	}
+
+	if err := authorize(ctx, resourceKV, true, kvName(pr.Buckets, pr.Key)); err != nil {
+		return database.PutOptions{}, err
+	}
+
+	f, err := fence(ctx, pr.Fence)
+	if err != nil {
+		return database.PutOptions{}, err
+	}
+
+	var owner, token string
+	if pr.Session != "" {
+		if owner, err = sessionOwner(ctx, pr.Who); err != nil {
+			return database.PutOptions{}, err
+		}
+		token = sessionToken(ctx)
+	}
+
+	var ttl *time.Duration
+	if pr.TTL != nil {
+		d := pr.TTL.AsDuration()
+		if d <= 0 {
+			return database.PutOptions{}, status.Error(codes.InvalidArgument, "ttl must be positive")
+		}
+		ttl = &d
+	}
+
+	return database.PutOptions{
+		Fence:      f,
+		Session:    pr.Session,
+		Owner:      owner,
+		Token:      token,
+		TTL:        ttl,
+		IfAbsent:   pr.IfAbsent,
+		IfValue:    pr.IfValue,
+		IfRevision: pr.IfRevision,
+		Writer:     writer(ctx),
+	}, nil
+}
+
+// Put will insert data in the kv store. If a fence is given, the data is only
+// inserted if the fence's lock is still held with the fence's token. If a
+// session owned by who is given, the data is deleted when the session ends
+// unless it is written again in the meantime, and if a ttl is given, once it
+// expires. The if_absent, if_value and if_revision conditions
+// make the put conditional, FailedPrecondition is returned if they aren't met.
+func (cap *CapybaraServer) Put(ctx context.Context, pr *pb.PutRequest) (*pb.PutResponse, error) {
+	opts, err := putArgs(ctx, pr)
+	if err != nil {
+		return nil, err
 	}
 
-	err := cap.db.Put(pr.Buckets, pr.Key, pr.Value)
+	rev, err := cap.db.PutWithOptions(pr.Buckets, pr.Key, pr.Value, opts)
 	if err != nil {
+		if serr := sessionError(err); serr != nil {
+			return nil, serr
+		}
+
+		if errors.Is(err, database.ErrInternalBucket) {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+
+		if errors.Is(err, database.ErrFenced) || errors.Is(err, database.ErrConditionFailed) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+
 		cap.log.Err(err).Str("buckets", strings.Join(pr.Buckets, "/")).Str("key", pr.Key).Msg("unable to put key")
 		return nil, status.Error(codes.Internal, "unable to put key")
 	}
 
-	return &pb.PutResponse{}, nil
+	return &pb.PutResponse{Revision: rev}, nil
 }
 
-// Get will return data from the kv store (if any).
-func (cap *CapybaraServer) Get(ctx context.Context, gr *pb.GetRequest) (*pb.GetResponse, error) {
+// getArgs validates a get request and checks that the token is allowed to
+// read the key.
+func getArgs(ctx context.Context, gr *pb.GetRequest) error {
 	if len(gr.Buckets) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "at least one bucket required")
+		return status.Error(codes.InvalidArgument, "at least one bucket required")
 	}
 
 	if gr.Key == "" {
-		return nil, status.Error(codes.InvalidArgument, "key can't be empty")
+		return status.Error(codes.InvalidArgument, "key can't be empty")
 	}
 
-	out, err := cap.db.Get(gr.Buckets, gr.Key)
+	return authorize(ctx, resourceKV, false, kvName(gr.Buckets, gr.Key))
+}
+
+// entryResponse returns the get response describing the entry.
+func entryResponse(e *pb.Entry) *pb.GetResponse {
+	return &pb.GetResponse{
+		Value:          e.Value,
+		Revision:       e.ModRevision,
+		CreateRevision: e.CreateRevision,
+		Version:        e.Version,
+		CreatedAt:      e.CreatedAt,
+		UpdatedAt:      e.UpdatedAt,
+		Writer:         e.Writer,
+		ValidUntil:     e.ValidUntil,
+	}
+}
+
+// Get will return data from the kv store, along with its revisions, when it
+// was created and updated and who last wrote it. An empty response is
+// returned if the key doesn't exist or expired.
+func (cap *CapybaraServer) Get(ctx context.Context, gr *pb.GetRequest) (*pb.GetResponse, error) {
+	if err := getArgs(ctx, gr); err != nil {
+		return nil, err
+	}
+
+	e, err := cap.db.GetEntry(gr.Buckets, gr.Key)
+	if errors.Is(err, database.ErrKeyNotFound) {
+		return &pb.GetResponse{}, nil
+	}
 	if err != nil {
 		if errors.Is(err, database.ErrBucketNotFound) {
 			return nil, status.Error(codes.NotFound, err.Error())
 		}
 
+		if errors.Is(err, database.ErrInternalBucket) {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+
 		cap.log.Err(err).Str("buckets", strings.Join(gr.Buckets, "|")).Str("key", gr.Key).Msg("unable to get key")
 
 		return nil, status.Error(codes.Internal, "unable to get key")
 	}
 
-	return &pb.GetResponse{Value: out}, nil
+	return entryResponse(e), nil
 }
 
-// Delete will delete data from the kv store.
-func (cap *CapybaraServer) Delete(ctx context.Context, dr *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+// deleteArgs validates a delete request, checks that the token is allowed to
+// delete the key and returns the options of the delete.
+func deleteArgs(ctx context.Context, dr *pb.DeleteRequest) (database.DeleteOptions, error) {
 	if len(dr.Buckets) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "at least one bucket required")
+		return database.DeleteOptions{}, status.Error(codes.InvalidArgument, "at least one bucket required")
 	}
 
 	if dr.Key == "" {
-		return nil, status.Error(codes.InvalidArgument, "key can't be empty")
+		return database.DeleteOptions{}, status.Error(codes.InvalidArgument, "key can't be empty")
 	}
 
-	err := cap.db.Delete(dr.Buckets, dr.Key)
+	if err := authorize(ctx, resourceKV, true, kvName(dr.Buckets, dr.Key)); err != nil {
+		return database.DeleteOptions{}, err
+	}
+
+	f, err := fence(ctx, dr.Fence)
+	if err != nil {
+		return database.DeleteOptions{}, err
+	}
+
+	return database.DeleteOptions{Fence: f, IfRevision: dr.IfRevision}, nil
+}
+
+// Delete will delete data from the kv store. If a fence is given, the data is
+// only deleted if the fence's lock is still held with the fence's token. If
+// if_revision is given, the data is only deleted if it has this revision,
+// FailedPrecondition is returned otherwise.
+func (cap *CapybaraServer) Delete(ctx context.Context, dr *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	opts, err := deleteArgs(ctx, dr)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cap.db.DeleteWithOptions(dr.Buckets, dr.Key, opts)
 	if err != nil {
 		if errors.Is(err, database.ErrBucketNotFound) {
 			return nil, status.Error(codes.NotFound, err.Error())
 		}
 
+		if errors.Is(err, database.ErrInternalBucket) {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+
+		if errors.Is(err, database.ErrFenced) || errors.Is(err, database.ErrConditionFailed) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+
 		cap.log.Err(err).Str("buckets", strings.Join(dr.Buckets, "|")).Str("key", dr.Key).Msg("unable to get key")
 
 		return nil, status.Error(codes.Internal, "unable to get key")
@@ -9,51 +9,195 @@ import (
 	"github.com/depado/capybara/pb"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
+// maxMetadataSize is the maximum encoded size of the metadata attached to a
+// lock claim.
+const maxMetadataSize = 4096
+
+// lockArgs validates the lock request and returns the key, owner and claim
+// options of the lock. When no who is given, the common name of the client
+// certificate is used. The ttl, if given, must be within the configured
+// bounds.
+func (cap *CapybaraServer) lockArgs(ctx context.Context, lr *pb.LockRequest) (string, string, database.ClaimOptions, error) {
+	k := lr.GetKey()
+	if k == "" {
+		return "", "", database.ClaimOptions{}, status.Errorf(codes.InvalidArgument, "missing key argument")
+	}
+
+	who := lr.GetWho()
+	if who == "" {
+		who = peerIdentity(ctx)
+	}
+	if who == "" {
+		return "", "", database.ClaimOptions{}, status.Errorf(codes.InvalidArgument, "missing who argument")
+	}
+
+	if err := authorize(ctx, resourceLock, true, k); err != nil {
+		return "", "", database.ClaimOptions{}, err
+	}
+
+	opts, err := cap.claimOptions(ctx, lr.TTL, lr.GetShared(), lr.GetMetadata(), lr.GetSession())
+	if err != nil {
+		return "", "", database.ClaimOptions{}, err
+	}
+
+	return k, who, opts, nil
+}
+
+// claimOptions validates the ttl and metadata of a lock claim and returns its
+// options. A ttl can't be given along with a session.
+func (cap *CapybaraServer) claimOptions(ctx context.Context, pbttl *durationpb.Duration, shared bool, md *pb.HolderMetadata, session string) (database.ClaimOptions, error) {
+	if session != "" && pbttl != nil {
+		return database.ClaimOptions{}, status.Errorf(codes.InvalidArgument, "ttl can't be given with a session")
+	}
+
+	ttl, err := cap.ttlArg(pbttl)
+	if err != nil {
+		return database.ClaimOptions{}, err
+	}
+
+	if proto.Size(md) > maxMetadataSize {
+		return database.ClaimOptions{}, status.Errorf(codes.InvalidArgument, "metadata must be at most %d bytes", maxMetadataSize)
+	}
+
+	opts := database.ClaimOptions{TTL: ttl, Shared: shared, Metadata: md, Session: session}
+	if session != "" {
+		opts.Token = sessionToken(ctx)
+	}
+
+	return opts, nil
+}
+
+// ttlArg validates the ttl of a lock or semaphore request, if given, against
+// the configured bounds.
+func (cap *CapybaraServer) ttlArg(pbttl *durationpb.Duration) (*time.Duration, error) {
+	if pbttl == nil {
+		return nil, nil
+	}
+
+	d := pbttl.AsDuration()
+	switch {
+	case d <= 0:
+		return nil, status.Errorf(codes.InvalidArgument, "ttl must be positive")
+	case d < cap.minTTL:
+		return nil, status.Errorf(codes.InvalidArgument, "ttl must be at least %s", cap.minTTL)
+	case d > cap.maxTTL:
+		return nil, status.Errorf(codes.InvalidArgument, "ttl must be at most %s", cap.maxTTL)
+	}
+
+	return &d, nil
+}
+
+// lockResponse creates the response sent back after a lock claim.
+func lockResponse(lock *pb.Lock, acquired bool) *pb.LockResponse {
+	return &pb.LockResponse{
+		Acquired:     acquired,
+		Owner:        lock.Owner,
+		CreatedAt:    lock.CreatedAt,
+		ValidUntil:   lock.ValidUntil,
+		FencingToken: lock.FencingToken,
+		Shared:       lock.Shared,
+		Holders:      lock.Holders,
+	}
+}
+
 // ClaimLock implements the CapybaraServer interface.
 // This function can be used to acquire a lock. If the lock is already owned
 // by another owner, the function will return the lock's details such as its
-// expiration date, creation date and who the owner is.
+// expiration date, creation date and who the owner is, along with the
+// metadata its holders attached to their claim. When no who is given,
+// the common name of the client certificate is used. Setting shared claims
+// a shared lock, which can be held by several owners at once. Setting session
+// attaches the hold to a session owned by the caller.
 func (cap *CapybaraServer) ClaimLock(ctx context.Context, lr *pb.LockRequest) (*pb.LockResponse, error) {
 	log := cap.log.With().Str("function", "ClaimLock").Logger()
 
-	k := lr.GetKey()
-	if k == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "missing key argument")
+	k, who, opts, err := cap.lockArgs(ctx, lr)
+	if err != nil {
+		return nil, err
 	}
 
-	who := lr.GetWho()
-	if who == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "missing who argument")
+	lock, ok, err := cap.db.ClaimLock(k, who, opts)
+	if err != nil {
+		if serr := sessionError(err); serr != nil {
+			return nil, serr
+		}
+		log.Err(err).Msg("unable to claim lock")
+		return nil, status.Errorf(codes.Internal, "an error occurred")
 	}
 
-	var ttl *time.Duration
+	return lockResponse(lock, ok), nil
+}
+
+// WaitLock implements the CapybaraServer interface.
+// This function acquires a lock like ClaimLock does, but blocks until the
+// lock is released or expires if it is owned by another owner. Waiting
+// clients are served in the order they arrived. The call returns with a
+// DeadlineExceeded error if the lock can't be acquired before the request's
+// deadline.
+func (cap *CapybaraServer) WaitLock(ctx context.Context, lr *pb.LockRequest) (*pb.LockResponse, error) {
+	log := cap.log.With().Str("function", "WaitLock").Logger()
 
-	pbttl := lr.TTL
-	if pbttl != nil {
-		d := pbttl.AsDuration()
-		ttl = &d
+	k, who, opts, err := cap.lockArgs(ctx, lr)
+	if err != nil {
+		return nil, err
 	}
 
-	lock, ok, err := cap.db.ClaimLock(k, who, ttl)
+	lock, ok, err := cap.db.WaitLock(ctx, k, who, opts)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		if serr := sessionError(err); serr != nil {
+			return nil, serr
+		}
 		log.Err(err).Msg("unable to claim lock")
 		return nil, status.Errorf(codes.Internal, "an error occurred")
 	}
 
-	resp := &pb.LockResponse{
-		Acquired:   ok,
-		Owner:      lock.Owner,
-		CreatedAt:  lock.CreatedAt,
-		ValidUntil: lock.ValidUntil,
+	return lockResponse(lock, ok), nil
+}
+
+// RefreshLock implements the CapybaraServer interface.
+// This function delays the expiration of a lock owned by the caller. Unlike
+// ClaimLock it never acquires the lock, so a client can tell it lost it:
+// NotFound is returned if the lock doesn't exist, FailedPrecondition if it
+// expired or is held through a session, and PermissionDenied if someone else
+// owns it.
+func (cap *CapybaraServer) RefreshLock(ctx context.Context, lr *pb.LockRequest) (*pb.LockResponse, error) {
+	log := cap.log.With().Str("function", "RefreshLock").Logger()
+
+	k, who, opts, err := cap.lockArgs(ctx, lr)
+	if err != nil {
+		return nil, err
 	}
 
-	return resp, nil
+	lock, err := cap.db.RefreshLock(k, who, opts.TTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrLockNotFound):
+			return nil, status.Errorf(codes.NotFound, "lock not found")
+		case errors.Is(err, database.ErrLockExpired):
+			return nil, status.Errorf(codes.FailedPrecondition, "lock expired")
+		case errors.Is(err, database.ErrSessionBound):
+			return nil, status.Errorf(codes.FailedPrecondition, "lock held through a session, keep the session alive instead")
+		case errors.Is(err, database.ErrNotOwner):
+			return nil, status.Errorf(codes.PermissionDenied, "not the owner of this lock")
+		default:
+			log.Err(err).Msg("unable to refresh lock")
+			return nil, status.Errorf(codes.Internal, "unable to refresh lock")
+		}
+	}
+
+	return lockResponse(lock, true), nil
 }
 
 // ReleaseLock is used to release a lock. This method will only work if the
-// client has ownership on the lock.
+// client has ownership on the lock. For shared locks, only the client's hold
+// is released.
 func (cap *CapybaraServer) ReleaseLock(ctx context.Context, rr *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
 	log := cap.log.With().Str("function", "ReleaseLock").Logger()
 
@@ -63,10 +207,17 @@ func (cap *CapybaraServer) ReleaseLock(ctx context.Context, rr *pb.ReleaseReques
 	}
 
 	who := rr.GetWho()
+	if who == "" {
+		who = peerIdentity(ctx)
+	}
 	if who == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "missing who argument")
 	}
 
+	if err := authorize(ctx, resourceLock, true, k); err != nil {
+		return nil, err
+	}
+
 	err := cap.db.ReleaseLock(k, who)
 	if err != nil {
 		switch {
@@ -87,3 +238,39 @@ func (cap *CapybaraServer) ReleaseLock(ctx context.Context, rr *pb.ReleaseReques
 
 	return resp, nil
 }
+
+// ForceReleaseLock implements the CapybaraServer interface.
+// This function releases a lock whoever holds it, or only the given holder
+// of the lock. It requires an admin token, or a lock scope with the admin
+// access. Forced releases are logged along with who forced them and why.
+func (cap *CapybaraServer) ForceReleaseLock(ctx context.Context, fr *pb.ForceReleaseRequest) (*pb.ForceReleaseResponse, error) {
+	log := cap.log.With().Str("function", "ForceReleaseLock").Logger()
+
+	k := fr.GetKey()
+	if k == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing key argument")
+	}
+
+	if err := authorizeAdmin(ctx, resourceLock, k); err != nil {
+		return nil, err
+	}
+
+	released, err := cap.db.ForceReleaseLock(k, fr.GetOwner())
+	if err != nil {
+		if errors.Is(err, database.ErrLockNotFound) {
+			return nil, status.Errorf(codes.NotFound, "lock not found")
+		}
+		log.Err(err).Msg("unable to force lock release")
+		return nil, status.Errorf(codes.Internal, "unable to force lock release")
+	}
+
+	owners := make([]string, 0, len(released))
+	for _, h := range released {
+		owners = append(owners, h.Owner)
+	}
+
+	log.Warn().Str("lock", k).Strs("owners", owners).Str("by", tokenFromContext(ctx).GetName()).
+		Str("peer", peerIdentity(ctx)).Str("reason", fr.GetReason()).Msg("lock release forced")
+
+	return &pb.ForceReleaseResponse{Holders: released}, nil
+}
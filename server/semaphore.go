@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/depado/capybara/database"
+	"github.com/depado/capybara/pb"
+)
+
+// semaphoreResponse creates the response sent back after a semaphore
+// acquisition.
+func semaphoreResponse(sem *pb.Semaphore, acquired bool) *pb.SemaphoreResponse {
+	return &pb.SemaphoreResponse{
+		Acquired: acquired,
+		Permits:  sem.Permits,
+		Holders:  sem.Holders,
+	}
+}
+
+// AcquireSemaphore implements the CapybaraServer interface.
+// This function acquires one of the permits of a semaphore. If all the permits
+// are held, acquired is false and the current holders are returned. Acquiring
+// again a permit the caller holds delays its expiration. FailedPrecondition is
+// returned if the semaphore is held with a different number of permits. When
+// no who is given, the common name of the client certificate is used.
+func (cap *CapybaraServer) AcquireSemaphore(ctx context.Context, sr *pb.SemaphoreRequest) (*pb.SemaphoreResponse, error) {
+	log := cap.log.With().Str("function", "AcquireSemaphore").Logger()
+
+	k := sr.GetKey()
+	if k == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing key argument")
+	}
+
+	who := sr.GetWho()
+	if who == "" {
+		who = peerIdentity(ctx)
+	}
+	if who == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing who argument")
+	}
+
+	if sr.GetPermits() == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "permits must be positive")
+	}
+
+	if err := authorize(ctx, resourceSemaphore, true, k); err != nil {
+		return nil, err
+	}
+
+	ttl, err := cap.ttlArg(sr.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	sem, ok, err := cap.db.AcquireSemaphore(k, who, sr.GetPermits(), ttl)
+	if errors.Is(err, database.ErrPermitsMismatch) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		log.Err(err).Msg("unable to acquire semaphore")
+		return nil, status.Errorf(codes.Internal, "an error occurred")
+	}
+
+	return semaphoreResponse(sem, ok), nil
+}
+
+// ReleaseSemaphore implements the CapybaraServer interface.
+// This function releases the semaphore permit held by the caller.
+func (cap *CapybaraServer) ReleaseSemaphore(ctx context.Context, rr *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+	log := cap.log.With().Str("function", "ReleaseSemaphore").Logger()
+
+	k := rr.GetKey()
+	if k == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing key argument")
+	}
+
+	who := rr.GetWho()
+	if who == "" {
+		who = peerIdentity(ctx)
+	}
+	if who == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing who argument")
+	}
+
+	if err := authorize(ctx, resourceSemaphore, true, k); err != nil {
+		return nil, err
+	}
+
+	if err := cap.db.ReleaseSemaphore(k, who); err != nil {
+		switch {
+		case errors.Is(err, database.ErrSemaphoreNotFound):
+			return nil, status.Errorf(codes.NotFound, "semaphore not found")
+		case errors.Is(err, database.ErrNotOwner):
+			return nil, status.Errorf(codes.PermissionDenied, "no permit held on this semaphore")
+		default:
+			log.Err(err).Msg("unable to release semaphore")
+			return nil, status.Errorf(codes.Internal, "unable to release semaphore")
+		}
+	}
+
+	return &pb.ReleaseResponse{}, nil
+}
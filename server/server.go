@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/depado/capybara/cmd"
 	"github.com/depado/capybara/database"
@@ -15,41 +16,93 @@ import (
 
 // CapybaraServer represents the GRPC server.
 type CapybaraServer struct {
-	db  *database.CapybaraDB
-	log zerolog.Logger
+	db       *database.CapybaraDB
+	log      zerolog.Logger
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	certAuth bool
 	pb.UnimplementedCapybaraServer
 }
 
+// Server is the GRPC server along with the certificate reloader it uses, if
+// TLS is enabled.
+type Server struct {
+	*grpc.Server
+	certs *certReloader
+}
+
+// Stop stops the GRPC server, closing the open connections, and stops
+// reloading the certificates.
+func (s *Server) Stop() {
+	s.Server.Stop()
+
+	if s.certs != nil {
+		if err := s.certs.Close(); err != nil {
+			s.certs.log.Err(err).Msg("unable to close certificate watcher")
+		}
+	}
+}
+
 // NewGRPCServer will create a new GRPC server given the proper configuration,
 // logger and database config.
-func NewGRPCServer(conf *cmd.Conf, l zerolog.Logger, cdb *database.CapybaraDB) (*grpc.Server, error) {
-	var gs *grpc.Server
+func NewGRPCServer(conf *cmd.Conf, l zerolog.Logger, cdb *database.CapybaraDB) (*Server, error) {
+	gs := &Server{}
+
+	for _, tc := range conf.Auth.Tokens {
+		if err := validateScopes(tc.Scopes); err != nil {
+			return nil, fmt.Errorf("token %s: %w", tc.Name, err)
+		}
+	}
+
+	dc := conf.Database
+	if dc.MinLockTTL <= 0 || dc.MaxLockTTL < dc.MinLockTTL {
+		return nil, fmt.Errorf("invalid lock ttl bounds: min %s, max %s", dc.MinLockTTL, dc.MaxLockTTL)
+	}
+	if dc.DefaultLockTTL < dc.MinLockTTL || dc.DefaultLockTTL > dc.MaxLockTTL {
+		return nil, fmt.Errorf("default lock ttl %s isn't between %s and %s", dc.DefaultLockTTL, dc.MinLockTTL, dc.MaxLockTTL)
+	}
 
 	cap := &CapybaraServer{
-		db:  cdb,
-		log: l.With().Str("component", "grpc").Logger(),
+		db:       cdb,
+		log:      l.With().Str("component", "grpc").Logger(),
+		minTTL:   dc.MinLockTTL,
+		maxTTL:   dc.MaxLockTTL,
+		certAuth: conf.Server.TLS.CertAuth && conf.Server.TLS.Type == cmd.TLSMutual,
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(cap.AuthInterceptor),
+		grpc.ChainStreamInterceptor(cap.AuthStreamInterceptor),
 	}
 
-	if conf.Server.TLS.CertPath != "" && conf.Server.TLS.KeyPath != "" {
-		tlsCredentials, err := loadTLSCredentials(conf.Server.TLS.CertPath, conf.Server.TLS.KeyPath)
+	switch conf.Server.TLS.Type {
+	case cmd.TLSServer, cmd.TLSMutual:
+		tlsCredentials, cr, err := loadTLSCredentials(conf.Server.TLS, l)
 		if err != nil {
 			return nil, fmt.Errorf("load TLS credentials: %w", err)
 		}
+		gs.certs = cr
+
+		l.Info().Str("cert", conf.Server.TLS.CertPath).Str("key", conf.Server.TLS.KeyPath).
+			Str("type", conf.Server.TLS.Type).Msg("loaded credentials")
 
-		l.Info().Str("cert", conf.Server.TLS.CertPath).Str("key", conf.Server.TLS.KeyPath).Msg("loaded credentials")
+		gs.Server = grpc.NewServer(append(opts, grpc.Creds(tlsCredentials))...)
+	case cmd.TLSDisable:
+		l.Warn().Msg("TLS is disabled, tokens are sent in clear")
 
-		gs = grpc.NewServer(grpc.Creds(tlsCredentials), grpc.ChainUnaryInterceptor(cap.AuthInterceptor))
-	} else {
-		gs = grpc.NewServer(grpc.ChainUnaryInterceptor(cap.AuthInterceptor))
+		gs.Server = grpc.NewServer(opts...)
+	default:
+		return nil, fmt.Errorf("unknown tls type %q", conf.Server.TLS.Type)
 	}
 
-	pb.RegisterCapybaraServer(gs, cap)
+	pb.RegisterCapybaraServer(gs.Server, cap)
 
 	return gs, nil
 }
 
-// Listen will start the GRPC server and listen on the configured port/host.
-func Listen(conf *cmd.Conf, log zerolog.Logger, gs *grpc.Server) {
+// Listen will start the GRPC server and listen on the configured port/host,
+// until the server is stopped.
+func Listen(conf *cmd.Conf, log zerolog.Logger, gs *Server) {
 	la := conf.Server.ListenAddr()
 
 	lis, err := net.Listen("tcp", la)
@@ -64,18 +117,35 @@ func Listen(conf *cmd.Conf, log zerolog.Logger, gs *grpc.Server) {
 	}
 }
 
-func loadTLSCredentials(cert, key string) (credentials.TransportCredentials, error) {
-	// Load server's certificate and private key
-	serverCert, err := tls.LoadX509KeyPair(cert, key)
+// loadTLSCredentials loads the server's certificate and, in mtls mode, the
+// CA used to verify the client certificates. They are reloaded when they
+// change on disk until the returned reloader is closed.
+func loadTLSCredentials(c cmd.TLSConfig, log zerolog.Logger) (credentials.TransportCredentials, *certReloader, error) {
+	var caPath string
+	if c.Type == cmd.TLSMutual {
+		caPath = c.CAPath
+	}
+
+	// Load server's certificate and private key, and the CA that signed the
+	// client certificates
+	cr, err := newCertReloader(c.CertPath, c.KeyPath, caPath, log)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Create the credentials and return it
 	config := &tls.Config{
-		Certificates: []tls.Certificate{serverCert},
-		ClientAuth:   tls.NoClientCert,
+		GetCertificate: cr.GetCertificate,
+		ClientAuth:     tls.NoClientCert,
 	}
 
-	return credentials.NewTLS(config), nil
+	if c.Type == cmd.TLSMutual {
+		// The configuration returned for a client replaces this one, on which
+		// grpc adds the http2 protocol
+		base := config.Clone()
+		base.NextProtos = []string{"h2"}
+		config.GetConfigForClient = cr.configForClient(base)
+	}
+
+	// Create the credentials and return it
+	return credentials.NewTLS(config), cr, nil
 }
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/depado/capybara/database"
+	"github.com/depado/capybara/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sessionError returns the status matching an error caused by the session a
+// request refers to, or nil if the error isn't caused by the session.
+func sessionError(err error) error {
+	switch {
+	case errors.Is(err, database.ErrSessionNotFound):
+		return status.Errorf(codes.NotFound, "session not found")
+	case errors.Is(err, database.ErrSessionExpired):
+		return status.Errorf(codes.FailedPrecondition, "session expired")
+	case errors.Is(err, database.ErrNotOwner):
+		return status.Errorf(codes.PermissionDenied, "not the owner of this session")
+	}
+
+	return nil
+}
+
+// sessionOwner returns who, or the common name of the client certificate if
+// who is empty.
+func sessionOwner(ctx context.Context, who string) (string, error) {
+	if who == "" {
+		who = peerIdentity(ctx)
+	}
+	if who == "" {
+		return "", status.Errorf(codes.InvalidArgument, "missing who argument")
+	}
+
+	return who, nil
+}
+
+// sessionToken returns the name of the token a session used by the request
+// must have been created with. Admin tokens can use every session, an empty
+// name is returned for them.
+func sessionToken(ctx context.Context) string {
+	tk := tokenFromContext(ctx)
+	if tk.GetAdmin() {
+		return ""
+	}
+
+	return tk.GetName()
+}
+
+// CreateSession implements the CapybaraServer interface.
+// This function creates a session owned by the caller, which can only be used
+// with the token it was created with, or with an admin token. Locks and kv entries
+// can be attached to the session, they are released and deleted when it is
+// closed or when it expires because it wasn't kept alive for its ttl. The
+// ttl, if given, must be within the configured lock bounds.
+func (cap *CapybaraServer) CreateSession(ctx context.Context, sr *pb.CreateSessionRequest) (*pb.Session, error) {
+	log := cap.log.With().Str("function", "CreateSession").Logger()
+
+	who, err := sessionOwner(ctx, sr.GetWho())
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, err := cap.ttlArg(sr.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := cap.db.CreateSession(who, tokenFromContext(ctx).GetName(), ttl)
+	if err != nil {
+		log.Err(err).Msg("unable to create session")
+		return nil, status.Errorf(codes.Internal, "unable to create session")
+	}
+
+	return sess, nil
+}
+
+// KeepAliveSession implements the CapybaraServer interface.
+// This function delays the expiration of a session owned by the caller, and
+// of every lock attached to it. NotFound is returned if the session doesn't
+// exist, FailedPrecondition if it expired and PermissionDenied if someone
+// else owns it or it was created with another token.
+func (cap *CapybaraServer) KeepAliveSession(ctx context.Context, sr *pb.SessionRequest) (*pb.Session, error) {
+	log := cap.log.With().Str("function", "KeepAliveSession").Logger()
+
+	if sr.GetId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing id argument")
+	}
+
+	who, err := sessionOwner(ctx, sr.GetWho())
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := cap.db.KeepAliveSession(sr.GetId(), who, sessionToken(ctx))
+	if err != nil {
+		if serr := sessionError(err); serr != nil {
+			return nil, serr
+		}
+		log.Err(err).Msg("unable to keep session alive")
+		return nil, status.Errorf(codes.Internal, "unable to keep session alive")
+	}
+
+	return sess, nil
+}
+
+// CloseSession implements the CapybaraServer interface.
+// This function ends a session owned by the caller, releasing the locks and
+// deleting the kv entries attached to it. PermissionDenied is returned if
+// someone else owns it or it was created with another token.
+func (cap *CapybaraServer) CloseSession(ctx context.Context, sr *pb.SessionRequest) (*pb.CloseSessionResponse, error) {
+	log := cap.log.With().Str("function", "CloseSession").Logger()
+
+	if sr.GetId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing id argument")
+	}
+
+	who, err := sessionOwner(ctx, sr.GetWho())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cap.db.CloseSession(sr.GetId(), who, sessionToken(ctx)); err != nil {
+		if serr := sessionError(err); serr != nil {
+			return nil, serr
+		}
+		log.Err(err).Msg("unable to close session")
+		return nil, status.Errorf(codes.Internal, "unable to close session")
+	}
+
+	return &pb.CloseSessionResponse{}, nil
+}
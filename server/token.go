@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/depado/capybara/database"
+	"github.com/depado/capybara/pb"
+)
+
+// CreateToken creates a new token and returns its secret. This is the only
+// time the secret is sent, only its hash is stored.
+func (cap *CapybaraServer) CreateToken(ctx context.Context, tr *pb.CreateTokenRequest) (*pb.CreateTokenResponse, error) {
+	log := cap.log.With().Str("function", "CreateToken").Logger()
+
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if tr.GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing name argument")
+	}
+
+	if err := validateScopes(tr.Scopes); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var ttl *time.Duration
+
+	if tr.TTL != nil {
+		d := tr.TTL.AsDuration()
+		if d <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "ttl must be positive")
+		}
+		ttl = &d
+	}
+
+	secret, tk, err := cap.db.CreateToken(tr.Name, ttl, tr.Admin, tr.Scopes)
+	if err != nil {
+		if errors.Is(err, database.ErrTokenExists) {
+			return nil, status.Errorf(codes.AlreadyExists, "token already exists")
+		}
+		log.Err(err).Msg("unable to create token")
+		return nil, status.Errorf(codes.Internal, "unable to create token")
+	}
+
+	log.Info().Str("name", tk.Name).Str("by", tokenFromContext(ctx).GetName()).Msg("token created")
+
+	tk.Hash = nil
+
+	return &pb.CreateTokenResponse{Secret: secret, Token: tk}, nil
+}
+
+// RevokeToken revokes a token. Requests using this token are rejected as soon
+// as this call returns.
+func (cap *CapybaraServer) RevokeToken(ctx context.Context, rr *pb.RevokeTokenRequest) (*pb.RevokeTokenResponse, error) {
+	log := cap.log.With().Str("function", "RevokeToken").Logger()
+
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if rr.GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing name argument")
+	}
+
+	if err := cap.db.RevokeToken(rr.Name); err != nil {
+		if errors.Is(err, database.ErrTokenNotFound) {
+			return nil, status.Errorf(codes.NotFound, "token not found")
+		}
+		log.Err(err).Msg("unable to revoke token")
+		return nil, status.Errorf(codes.Internal, "unable to revoke token")
+	}
+
+	log.Info().Str("name", rr.Name).Str("by", tokenFromContext(ctx).GetName()).Msg("token revoked")
+
+	return &pb.RevokeTokenResponse{}, nil
+}
+
+// ListTokens lists all the tokens. The hashes are never sent back.
+func (cap *CapybaraServer) ListTokens(ctx context.Context, lr *pb.ListTokensRequest) (*pb.ListTokensResponse, error) {
+	log := cap.log.With().Str("function", "ListTokens").Logger()
+
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	tokens, err := cap.db.ListTokens()
+	if err != nil {
+		log.Err(err).Msg("unable to list tokens")
+		return nil, status.Errorf(codes.Internal, "unable to list tokens")
+	}
+
+	for _, tk := range tokens {
+		tk.Hash = nil
+	}
+
+	return &pb.ListTokensResponse{Tokens: tokens}, nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/depado/capybara/database"
+	"github.com/depado/capybara/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxTxnOps is the maximum number of comparisons, and of operations in each
+// branch, of a transaction.
+const maxTxnOps = 128
+
+// compareArgs validates a transaction comparison and checks that the token is
+// allowed to read the compared key.
+func compareArgs(ctx context.Context, c *pb.Compare) error {
+	if len(c.Buckets) == 0 {
+		return status.Error(codes.InvalidArgument, "at least one bucket required")
+	}
+
+	if c.Key == "" {
+		return status.Error(codes.InvalidArgument, "key can't be empty")
+	}
+
+	if c.Target == nil {
+		return status.Error(codes.InvalidArgument, "missing compare target")
+	}
+
+	if _, ok := pb.Compare_Result_name[int32(c.Result)]; !ok {
+		return status.Errorf(codes.InvalidArgument, "unknown compare result %d", c.Result)
+	}
+
+	return authorize(ctx, resourceKV, false, kvName(c.Buckets, c.Key))
+}
+
+// txnOp validates a transaction operation, checks that the token is allowed
+// to run it and returns it as a database operation.
+func txnOp(ctx context.Context, op *pb.RequestOp) (database.TxnOp, error) {
+	switch r := op.GetRequest().(type) {
+	case *pb.RequestOp_Put:
+		opts, err := putArgs(ctx, r.Put)
+		if err != nil {
+			return database.TxnOp{}, err
+		}
+		return database.TxnOp{Type: database.TxnPut, Buckets: r.Put.Buckets, Key: r.Put.Key, Value: r.Put.Value, PutOptions: opts}, nil
+
+	case *pb.RequestOp_Get:
+		if err := getArgs(ctx, r.Get); err != nil {
+			return database.TxnOp{}, err
+		}
+		return database.TxnOp{Type: database.TxnGet, Buckets: r.Get.Buckets, Key: r.Get.Key}, nil
+
+	case *pb.RequestOp_Delete:
+		opts, err := deleteArgs(ctx, r.Delete)
+		if err != nil {
+			return database.TxnOp{}, err
+		}
+		return database.TxnOp{Type: database.TxnDelete, Buckets: r.Delete.Buckets, Key: r.Delete.Key, DeleteOptions: opts}, nil
+
+	case *pb.RequestOp_Range:
+		if len(r.Range.Buckets) == 0 {
+			return database.TxnOp{}, status.Error(codes.InvalidArgument, "at least one bucket required")
+		}
+
+		limit := int(r.Range.Limit)
+		switch {
+		case limit == 0:
+			limit = defaultListLimit
+		case limit > maxListLimit:
+			return database.TxnOp{}, status.Errorf(codes.InvalidArgument, "limit must be at most %d", maxListLimit)
+		}
+
+		if err := authorizePrefix(ctx, resourceKV, false, kvName(r.Range.Buckets, r.Range.Prefix)); err != nil {
+			return database.TxnOp{}, err
+		}
+		return database.TxnOp{Type: database.TxnRange, Buckets: r.Range.Buckets, Key: r.Range.Prefix, Limit: limit}, nil
+	}
+
+	return database.TxnOp{}, status.Error(codes.InvalidArgument, "missing operation request")
+}
+
+// txnOps validates the operations of a transaction branch.
+func txnOps(ctx context.Context, reqs []*pb.RequestOp) ([]database.TxnOp, error) {
+	if len(reqs) > maxTxnOps {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d operations can be given", maxTxnOps)
+	}
+
+	ops := make([]database.TxnOp, 0, len(reqs))
+	for _, r := range reqs {
+		op, err := txnOp(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+// txnResponse returns the response of a transaction operation.
+func txnResponse(op database.TxnOp, res database.TxnResult) *pb.ResponseOp {
+	switch op.Type {
+	case database.TxnPut:
+		return &pb.ResponseOp{Response: &pb.ResponseOp_Put{Put: &pb.PutResponse{Revision: res.Revision}}}
+	case database.TxnGet:
+		gr := &pb.GetResponse{}
+		if res.Entry != nil {
+			gr = entryResponse(res.Entry)
+		}
+		return &pb.ResponseOp{Response: &pb.ResponseOp_Get{Get: gr}}
+	case database.TxnDelete:
+		return &pb.ResponseOp{Response: &pb.ResponseOp_Delete{Delete: &pb.DeleteResponse{}}}
+	}
+
+	rr := &pb.RangeResponse{More: res.More}
+	for _, ke := range res.Entries {
+		rr.Kvs = append(rr.Kvs, &pb.KeyValue{Key: ke.Key, Entry: entryResponse(ke.Entry)})
+	}
+	return &pb.ResponseOp{Response: &pb.ResponseOp_Range{Range: rr}}
+}
+
+// Txn runs kv operations atomically: the success operations are run if every
+// comparison succeeds, the failure operations otherwise, all of them in a
+// single transaction. If an operation fails, none of them is applied and the
+// error is returned the way the matching kv RPC would return it. Every
+// compared key and operation is authorized, even those of the branch that
+// isn't run.
+func (cap *CapybaraServer) Txn(ctx context.Context, tr *pb.TxnRequest) (*pb.TxnResponse, error) {
+	if len(tr.Compare) > maxTxnOps {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d comparisons can be given", maxTxnOps)
+	}
+
+	for _, c := range tr.Compare {
+		if err := compareArgs(ctx, c); err != nil {
+			return nil, err
+		}
+	}
+
+	success, err := txnOps(ctx, tr.Success)
+	if err != nil {
+		return nil, err
+	}
+
+	failure, err := txnOps(ctx, tr.Failure)
+	if err != nil {
+		return nil, err
+	}
+
+	succeeded, results, err := cap.db.Txn(tr.Compare, success, failure)
+	if err != nil {
+		if serr := sessionError(err); serr != nil {
+			return nil, serr
+		}
+
+		switch {
+		case errors.Is(err, database.ErrBucketNotFound):
+			return nil, status.Error(codes.NotFound, err.Error())
+		case errors.Is(err, database.ErrInternalBucket):
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		case errors.Is(err, database.ErrFenced), errors.Is(err, database.ErrConditionFailed):
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		case errors.Is(err, database.ErrIncompatibleValue):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		cap.log.Err(err).Msg("unable to run transaction")
+		return nil, status.Error(codes.Internal, "unable to run transaction")
+	}
+
+	ops := success
+	if !succeeded {
+		ops = failure
+	}
+
+	resp := &pb.TxnResponse{Succeeded: succeeded}
+	for i, res := range results {
+		resp.Responses = append(resp.Responses, txnResponse(ops[i], res))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/depado/capybara/pb"
+)
+
+// watchAuthInterval is the interval at which the token of an idle watch stream
+// is checked again.
+const watchAuthInterval = 10 * time.Second
+
+// reauthorize fetches the token the stream was authenticated with again and
+// checks that it is still valid, that its secret didn't change and that the
+// authorized function accepts it.
+func (cap *CapybaraServer) reauthorize(ctx context.Context, authorized func(ctx context.Context) error) error {
+	current := tokenFromContext(ctx)
+
+	tk, err := cap.db.AuthenticateName(current.GetName())
+	if err == nil && !bytes.Equal(tk.Hash, current.GetHash()) {
+		err = errors.New("token secret changed")
+	}
+	if err != nil {
+		cap.log.Debug().Err(err).Str("token", current.GetName()).Msg("watch token no longer valid")
+		return status.Errorf(codes.Unauthenticated, "token no longer valid")
+	}
+
+	return authorized(context.WithValue(ctx, tokenKey{}, tk))
+}
+
+// WatchLocks streams the events (acquired, refreshed, released, expired) of a
+// lock, or of every lock whose key starts with the given key if prefix is set.
+// With with_current, the stream starts with a CURRENT event for the lock or
+// for every held lock starting with the prefix. The stream ends with a
+// ResourceExhausted error if the client doesn't consume the events fast
+// enough. The token is checked again before each event and periodically, the
+// stream ends as soon as the token is revoked, expires or no longer grants the
+// access.
+func (cap *CapybaraServer) WatchLocks(wr *pb.WatchRequest, stream pb.Capybara_WatchLocksServer) error {
+	ctx := stream.Context()
+	log := cap.log.With().Str("function", "WatchLocks").Logger()
+
+	k := wr.GetKey()
+	if k == "" && !wr.GetPrefix() {
+		return status.Errorf(codes.InvalidArgument, "missing key argument")
+	}
+
+	authorized := func(ctx context.Context) error {
+		if wr.GetPrefix() {
+			return authorizePrefix(ctx, resourceLock, false, k)
+		}
+		return authorize(ctx, resourceLock, false, k)
+	}
+	if err := authorized(ctx); err != nil {
+		return err
+	}
+
+	events, cancel, err := cap.db.WatchLocks(k, wr.GetPrefix(), wr.GetWithCurrent())
+	if err != nil {
+		log.Err(err).Msg("unable to watch locks")
+		return status.Errorf(codes.Internal, "unable to watch locks")
+	}
+	defer cancel()
+
+	t := time.NewTicker(watchAuthInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if err := cap.reauthorize(ctx, authorized); err != nil {
+				return err
+			}
+		case ev, ok := <-events:
+			if !ok {
+				return status.Errorf(codes.ResourceExhausted, "too many pending events")
+			}
+			if err := cap.reauthorize(ctx, authorized); err != nil {
+				return err
+			}
+			if err := stream.Send(ev); err != nil {
+				log.Debug().Err(err).Msg("unable to send event")
+				return err
+			}
+		}
+	}
+}